@@ -0,0 +1,284 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// ZIP with all data of current user: profile, posts, comments, reactions,
+// claims, conversations and sent messages, bookmarks, follows, muted and
+// blocked users, avatar and images used in posts, comments and messages
+func export(w http.ResponseWriter, r *http.Request) {
+	uid := ctx("user", r).(ctxData).ID
+
+	var profile []struct {
+		UserID     int64  `json:"userID"`
+		Username   string `json:"username"`
+		Fullname   string `json:"fullname"`
+		Email      string `json:"email"`
+		Role       string `json:"role"`
+		Registered int64  `json:"registered"`
+		Language   string `json:"language"`
+		Timezone   string `json:"timezone"`
+	}
+	query := `SELECT userId, username, fullname, email, role, CAST(strftime('%s', registered) AS INT), language, timezone FROM users WHERE userId = $1`
+	sliceFromDB(&profile, query, nil, uid)
+	if len(profile) == 0 {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	var settings []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	sliceFromDB(&settings, `SELECT name, value FROM settings WHERE userId = $1 ORDER BY name`, nil, uid)
+
+	var posts []struct {
+		PostID     int64         `json:"pid"`
+		Posted     int64         `json:"created"`
+		Title      string        `json:"title"`
+		Text       string        `json:"text"`
+		Status     int64         `json:"status"`
+		Categories []interface{} `json:"categories"`
+	}
+	query = `SELECT postId, CAST(strftime('%s', posted) AS INT), title, text, status, categories FROM posts WHERE userId = $1 ORDER BY postId`
+	sliceFromDB(&posts, query, getCats, uid)
+
+	var comments []struct {
+		CommentID int64  `json:"cid"`
+		PostID    int64  `json:"pid"`
+		Commented int64  `json:"created"`
+		Comment   string `json:"comment"`
+		Status    int64  `json:"status"`
+	}
+	query = `SELECT commentId, postId, CAST(strftime('%s', commented) AS INT), comment, status FROM comments WHERE userId = $1 ORDER BY commentId`
+	sliceFromDB(&comments, query, nil, uid)
+
+	var reactions []struct {
+		PostID    int64  `json:"pid"`
+		CommentID int64  `json:"cid"`
+		Reacted   int64  `json:"reacted"`
+		Reaction  string `json:"reaction"`
+	}
+	query = `
+	SELECT postId, 0, CAST(strftime('%s', reacted) AS INT), reaction FROM postReactions WHERE userId = $1
+	UNION ALL
+	SELECT 0, commentId, CAST(strftime('%s', reacted) AS INT), reaction FROM commentReactions WHERE userId = $1`
+	sliceFromDB(&reactions, query, nil, uid)
+
+	var claims []struct {
+		ClaimID int64  `json:"claimID"`
+		Claimed int64  `json:"claimed"`
+		Type    string `json:"type"`
+		TextID  int64  `json:"textID"`
+		Claim   string `json:"claim"`
+		Reason  string `json:"reason"`
+		Status  int64  `json:"status"`
+	}
+	query = `SELECT claimId, CAST(strftime('%s', claimed) AS INT), type, textId, claim, reason, status FROM claims WHERE userId = $1 ORDER BY claimId`
+	sliceFromDB(&claims, query, nil, uid)
+
+	var conversations []struct {
+		ConversationID int64         `json:"id"`
+		Created        int64         `json:"created"`
+		Title          string        `json:"title"`
+		Members        []interface{} `json:"members"`
+	}
+	query = `
+	SELECT c.conversationId, CAST(strftime('%s', c.created) AS INT), c.title,
+		(SELECT GROUP_CONCAT(username) FROM users u JOIN conversationMembers o ON o.userId = u.userId WHERE o.conversationId = c.conversationId)
+	FROM conversations c JOIN conversationMembers cm ON cm.conversationId = c.conversationId AND cm.userId = $1
+	ORDER BY c.conversationId`
+	sliceFromDB(&conversations, query, splitUsernames, uid)
+
+	var messages []struct {
+		MessageID      int64  `json:"id"`
+		ConversationID int64  `json:"conversationID"`
+		Sent           int64  `json:"sent"`
+		Text           string `json:"text"`
+		Attachment     string `json:"attachment"`
+	}
+	query = `SELECT messageId, conversationId, CAST(strftime('%s', sent) AS INT), text, attachment FROM messages WHERE userId = $1 ORDER BY messageId`
+	sliceFromDB(&messages, query, nil, uid)
+
+	var bookmarks []struct {
+		PostID    int64  `json:"postID"`
+		CommentID int64  `json:"commentID"`
+		Created   int64  `json:"created"`
+		Folder    string `json:"folder"`
+		Note      string `json:"note"`
+	}
+	query = `SELECT postId, commentId, CAST(strftime('%s', created) AS INT), folder, note FROM bookmarks WHERE userId = $1 ORDER BY bookmarkId`
+	sliceFromDB(&bookmarks, query, nil, uid)
+
+	var follows []struct {
+		Type     string `json:"type"`
+		TargetID int64  `json:"id"`
+	}
+	query = `
+	SELECT type, targetId FROM follows WHERE userId = $1
+	UNION ALL
+	SELECT 'category', categoryId FROM categorySubscriptions WHERE userId = $1`
+	sliceFromDB(&follows, query, nil, uid)
+
+	var blocks []struct {
+		UserID  int64  `json:"userID"`
+		Kind    string `json:"kind"`
+		Created int64  `json:"created"`
+	}
+	query = `SELECT targetId, kind, CAST(strftime('%s', created) AS INT) FROM userBlocks WHERE userId = $1 ORDER BY created`
+	sliceFromDB(&blocks, query, nil, uid)
+
+	// Uploaded files are not linked to users, so images are found by their URLs in texts
+	files := []string{"/avatars/" + strconv.FormatInt(uid, 10) + ".jpg"}
+	images := regexp.MustCompile(`/images/[a-zA-Z0-9_.-]+`)
+	for _, p := range posts {
+		files = append(files, images.FindAllString(p.Text, -1)...)
+	}
+	for _, c := range comments {
+		files = append(files, images.FindAllString(c.Comment, -1)...)
+	}
+	for _, m := range messages {
+		files = append(files, images.FindAllString(m.Text+" "+m.Attachment, -1)...)
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+profile[0].Username+`.zip"`)
+	archive := zip.NewWriter(w)
+	add := func(name string, data []byte) {
+		f, createError := archive.Create(name)
+		err(createError)
+		_, writeError := f.Write(data)
+		err(writeError)
+	}
+	addJSON := func(name string, v interface{}) {
+		data, jsonError := json.MarshalIndent(v, "", "  ")
+		err(jsonError)
+		add(name, data)
+	}
+
+	addJSON("profile.json", profile[0])
+	addJSON("settings.json", settings)
+	addJSON("posts.json", posts)
+	addJSON("comments.json", comments)
+	addJSON("reactions.json", reactions)
+	addJSON("claims.json", claims)
+	addJSON("conversations.json", conversations)
+	addJSON("messages.json", messages)
+	addJSON("bookmarks.json", bookmarks)
+	addJSON("follows.json", follows)
+	addJSON("blocks.json", blocks)
+
+	added := make(map[string]bool)
+	for _, f := range files {
+		data, readError := ioutil.ReadFile(filepath.Join("./front", f))
+		if readError != nil || added[f] {
+			continue
+		}
+		added[f] = true
+		add(f[1:], data)
+	}
+	err(archive.Close())
+}
+
+// Schedule deletion of current account after grace period, password is required
+func deleteaccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	readBody(r, &req)
+	uid := ctx("user", r).(ctxData).ID
+
+	var creds []struct {
+		Password string
+	}
+	sliceFromDB(&creds, `SELECT password FROM users WHERE userId = $1`, nil, uid)
+	if len(creds) == 0 || !cryptIsValid(creds[0].Password, req.Password) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+
+	var res struct {
+		DeleteAt int64 `json:"deleteAt"`
+	}
+	res.DeleteAt = time.Now().Add(accountDeleteGrace).Unix()
+	setSetting(uid, "deleteAt", strconv.FormatInt(res.DeleteAt, 10))
+	returnJSON(res, w)
+}
+
+// User changed their mind during grace period
+func canceldeletion(w http.ResponseWriter, r *http.Request) {
+	err(insert(`DELETE FROM settings WHERE userId = $1 AND name = 'deleteAt'`, false, ctx("user", r).(ctxData).ID))
+}
+
+// Delete accounts which grace period is over
+func deleteAccounts() {
+	var due []struct {
+		ID int64
+	}
+	query := `SELECT userId FROM settings WHERE name = 'deleteAt' AND CAST(value AS INT) <= $1`
+	sliceFromDB(&due, query, nil, time.Now().Unix())
+	for _, u := range due {
+		anonymize(u.ID)
+	}
+}
+
+// Remove personal data of user, published posts and comments stay in place
+// (so threads are not broken) but their author becomes "deleted-ID". Same
+// is for messages, user leaves conversations and ones left without members
+// are deleted
+func anonymize(userID int64) {
+	queries := []string{
+		`DELETE FROM mailQueue WHERE sent IS NULL AND recipient = (SELECT email FROM users WHERE userId = $1)`,
+		`UPDATE users SET
+			username = 'deleted-' || userId,
+			fullname = 'Deleted user',
+			email = 'deleted-' || userId || '@deleted.invalid',
+			password = '',
+			language = 'en',
+			timezone = 'UTC',
+			role = '` + defaultRole + `',
+			trustLevel = NULL
+			WHERE userId = $1`,
+		`DELETE FROM posts WHERE userId = $1 AND status = 3`,
+		`DELETE FROM settings WHERE userId = $1`,
+		`DELETE FROM notifications WHERE userId = $1`,
+		`DELETE FROM categorySubscriptions WHERE userId = $1`,
+		`DELETE FROM categoryModerators WHERE userId = $1`,
+		`DELETE FROM userBlocks WHERE userId = $1 OR targetId = $1`,
+		`DELETE FROM bookmarks WHERE userId = $1`,
+		`DELETE FROM follows WHERE userId = $1 OR (type = 'user' AND targetId = $1)`,
+		`DELETE FROM postReads WHERE userId = $1`,
+		`DELETE FROM messages WHERE conversationId IN (SELECT conversationId FROM conversationMembers WHERE userId = $1)
+			AND conversationId NOT IN (SELECT conversationId FROM conversationMembers WHERE userId != $1)`,
+		`DELETE FROM conversations WHERE conversationId IN (SELECT conversationId FROM conversationMembers WHERE userId = $1)
+			AND conversationId NOT IN (SELECT conversationId FROM conversationMembers WHERE userId != $1)`,
+		`DELETE FROM conversationMembers WHERE userId = $1`,
+
+		// Mentions of user become plain text when texts are rendered again
+		`UPDATE posts SET html = '' WHERE postId IN (SELECT postId FROM mentions WHERE userId = $1 AND commentId = 0)`,
+		`UPDATE comments SET html = '' WHERE commentId IN (SELECT commentId FROM mentions WHERE userId = $1)`,
+		`DELETE FROM mentions WHERE userId = $1`,
+	}
+	err(execTx(func(tx *sql.Tx) error {
+		for _, query := range queries {
+			if _, execError := tx.Exec(query, userID); execError != nil {
+				return execError
+			}
+		}
+		return nil
+	}))
+
+	endSession(userID)
+	os.Remove("./front/avatars/" + strconv.FormatInt(userID, 10) + ".jpg")
+	renderMissing()
+}
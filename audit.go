@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Entry of audit log, before and after are JSON snapshots of target
+type auditEntry struct {
+	EntryID    int64  `json:"id"`
+	Created    int64  `json:"created"`
+	ActorID    int64  `json:"actorID"`
+	Actor      string `json:"actor"`
+	Action     string `json:"action"`
+	TargetType string `json:"targetType"`
+	TargetID   int64  `json:"targetID"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	IP         string `json:"ip"`
+}
+
+// IP address of client, port is dropped
+func clientIP(r *http.Request) string {
+	host, _, splitError := net.SplitHostPort(r.RemoteAddr)
+	if splitError != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// Record privileged action of current user, before and after are snapshots
+// of target (nil if it didn't exist before or doesn't exist after)
+func audit(r *http.Request, action, targetType string, targetID int64, before, after interface{}) {
+	snapshot := func(v interface{}) string {
+		if v == nil {
+			return ""
+		}
+		data, jsonError := json.Marshal(v)
+		err(jsonError)
+		return string(data)
+	}
+	query := `INSERT INTO auditLog(actorId, action, targetType, targetId, before, after, ip) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	err(insert(query, false, ctx("user", r).(ctxData).ID, action, targetType, targetID, snapshot(before), snapshot(after), clientIP(r)))
+}
+
+// Snapshots of audited targets, nil if there is no such one
+
+func postSnapshot(postID int64) interface{} {
+	var post []struct {
+		PostID       int64  `json:"pid"`
+		UserID       int64  `json:"uid"`
+		Title        string `json:"title"`
+		Text         string `json:"text"`
+		Categories   string `json:"categories"`
+		Status       int64  `json:"status"`
+		Pinned       int64  `json:"pinned"`
+		Locked       int64  `json:"locked"`
+		Announcement int64  `json:"announcement"`
+	}
+	query := `SELECT postId, userId, title, text, categories, status, pinned, locked, announcement FROM posts WHERE postId = $1`
+	sliceFromDB(&post, query, nil, postID)
+	if len(post) == 0 {
+		return nil
+	}
+	return post[0]
+}
+
+func commentSnapshot(commentID int64) interface{} {
+	var comment []struct {
+		CommentID int64  `json:"cid"`
+		PostID    int64  `json:"pid"`
+		UserID    int64  `json:"uid"`
+		Comment   string `json:"comment"`
+		Status    int64  `json:"status"`
+	}
+	query := `SELECT commentId, postId, userId, comment, status FROM comments WHERE commentId = $1`
+	sliceFromDB(&comment, query, nil, commentID)
+	if len(comment) == 0 {
+		return nil
+	}
+	return comment[0]
+}
+
+func userSnapshot(userID int64) interface{} {
+	var user []struct {
+		UserID   int64  `json:"uid"`
+		Username string `json:"username"`
+		Role     string `json:"role"`
+		Status   int64  `json:"status"`
+	}
+	sliceFromDB(&user, `SELECT userId, username, role, status FROM users WHERE userId = $1`, nil, userID)
+	if len(user) == 0 {
+		return nil
+	}
+	return user[0]
+}
+
+func categorySnapshot(categoryID int64) interface{} {
+	var cat []struct {
+		CategoryID  int64  `json:"id"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	sliceFromDB(&cat, `SELECT categoryId, name, description FROM categories WHERE categoryId = $1`, nil, categoryID)
+	if len(cat) == 0 {
+		return nil
+	}
+	return cat[0]
+}
+
+func roleSnapshot(role string) interface{} {
+	var found []struct {
+		Role        string `json:"role"`
+		Permissions string `json:"permissions"`
+	}
+	sliceFromDB(&found, `SELECT role, permissions FROM roles WHERE role = $1`, nil, role)
+	if len(found) == 0 {
+		return nil
+	}
+	return found[0]
+}
+
+func caseSnapshot(caseID int64) interface{} {
+	found, ok := getCase(caseID)
+	if !ok {
+		return nil
+	}
+	return found
+}
+
+// Audit log entries matching filters, newest first
+func auditEntries(r *http.Request, limit, offset int) []auditEntry {
+	actor, _ := strconv.ParseInt(r.FormValue("actorID"), 10, 64)
+	target, _ := strconv.ParseInt(r.FormValue("targetID"), 10, 64)
+	from, _ := strconv.ParseInt(r.FormValue("from"), 10, 64)
+	to, _ := strconv.ParseInt(r.FormValue("to"), 10, 64)
+
+	entries := []auditEntry{}
+	query := `
+	SELECT
+		a.entryId,
+		CAST(strftime('%s', a.created) AS INT),
+		a.actorId,
+		COALESCE((SELECT username FROM users u WHERE u.userId = a.actorId), ''),
+		a.action,
+		a.targetType,
+		a.targetId,
+		a.before,
+		a.after,
+		a.ip
+	FROM auditLog a
+	WHERE ($1 = 0 OR a.actorId = $1)
+		AND a.action LIKE $2
+		AND a.targetType LIKE $3
+		AND ($4 = 0 OR a.targetId = $4)
+		AND ($5 = 0 OR a.created >= datetime($5, 'unixepoch'))
+		AND ($6 = 0 OR a.created < datetime($6, 'unixepoch'))
+	ORDER BY a.entryId DESC LIMIT $7 OFFSET $8`
+	sliceFromDB(&entries, query, nil, actor, reqQuery("action", r), reqQuery("targetType", r), target, from, to, limit, offset)
+	return entries
+}
+
+// Audit log page by page, filtered by ?actorID=, ?action=, ?targetType=,
+// ?targetID= and time range ?from= and ?to= (unix time)
+func auditlog(w http.ResponseWriter, r *http.Request) {
+	if !can(ctx("user", r).(ctxData), permAuditView) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	pageSize := 50
+	page, atoiError := strconv.Atoi(r.FormValue("page"))
+	if atoiError != nil || page <= 0 {
+		page = 1
+	}
+	returnJSON(auditEntries(r, pageSize, page*pageSize-pageSize), w)
+}
+
+// All entries matching the same filters as a file, ?format= is "csv" or "json"
+func auditexport(w http.ResponseWriter, r *http.Request) {
+	if !can(ctx("user", r).(ctxData), permAuditView) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	format := r.FormValue("format")
+	if format != "csv" && format != "json" {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	entries := auditEntries(r, -1, 0)
+
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.`+format+`"`)
+	if format == "json" {
+		returnJSON(entries, w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	out := csv.NewWriter(w)
+	err(out.Write([]string{"id", "created", "actorID", "actor", "action", "targetType", "targetID", "before", "after", "ip"}))
+	for _, e := range entries {
+		err(out.Write([]string{
+			strconv.FormatInt(e.EntryID, 10),
+			time.Unix(e.Created, 0).UTC().Format(time.RFC3339),
+			strconv.FormatInt(e.ActorID, 10),
+			e.Actor,
+			e.Action,
+			e.TargetType,
+			strconv.FormatInt(e.TargetID, 10),
+			e.Before,
+			e.After,
+			e.IP,
+		}))
+	}
+	out.Flush()
+	err(out.Error())
+}
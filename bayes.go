@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Texts longer than this are classified by their first distinct tokens
+const bayesMaxTokens = 300
+
+// Distinct lowercase words of text, too short and too long ones are skipped
+func spamTokenize(text string) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	words := strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	})
+	for _, word := range words {
+		n := len([]rune(word))
+		if n < 3 || n > 30 || seen[word] {
+			continue
+		}
+		seen[word] = true
+		tokens = append(tokens, word)
+		if len(tokens) == bayesMaxTokens {
+			break
+		}
+	}
+	return tokens
+}
+
+// Count text as spam or ham, row with empty token counts texts themselves
+func trainSpam(text string, spam bool) {
+	column := "ham"
+	if spam {
+		column = "spam"
+	}
+	query := `INSERT INTO spamTokens(token, ` + column + `) VALUES ($1, 1) ON CONFLICT(token) DO UPDATE SET ` + column + ` = ` + column + ` + 1`
+	err(execTx(func(tx *sql.Tx) error {
+		for _, token := range append([]string{""}, spamTokenize(text)...) {
+			if _, execError := tx.Exec(query, token); execError != nil {
+				return execError
+			}
+		}
+		return nil
+	}))
+}
+
+// Text of reported post or comment, typ is "post" or "comment"
+func reportedText(typ string, textID int64) string {
+	var text []struct {
+		Text string
+	}
+	query := `SELECT title || char(10) || text FROM posts WHERE postId = $1`
+	if typ == "comment" {
+		query = `SELECT comment FROM comments WHERE commentId = $1`
+	}
+	sliceFromDB(&text, query, nil, textID)
+	if len(text) == 0 {
+		return ""
+	}
+	return text[0].Text
+}
+
+// Probability that text is spam by naive Bayes over token frequencies in
+// spam and ham texts. Not trained until both kinds have bayesMinDocs texts
+func spamProbability(text string) (float64, bool) {
+	tokens := spamTokenize(text)
+	args := []interface{}{""}
+	for _, t := range tokens {
+		args = append(args, t)
+	}
+	var counts []struct {
+		Token string
+		Spam  int64
+		Ham   int64
+	}
+	query := `SELECT token, spam, ham FROM spamTokens WHERE token IN (?` + strings.Repeat(", ?", len(tokens)) + `)`
+	sliceFromDB(&counts, query, nil, args...)
+
+	var docs struct{ Spam, Ham float64 }
+	for _, c := range counts {
+		if c.Token == "" {
+			docs.Spam, docs.Ham = float64(c.Spam), float64(c.Ham)
+		}
+	}
+	if docs.Spam < bayesMinDocs || docs.Ham < bayesMinDocs {
+		return 0, false
+	}
+
+	// Log odds with Laplace smoothing, unknown tokens say nothing
+	odds := math.Log(docs.Spam / docs.Ham)
+	for _, c := range counts {
+		if c.Token == "" {
+			continue
+		}
+		odds += math.Log((float64(c.Spam)+1)/(docs.Spam+2)) - math.Log((float64(c.Ham)+1)/(docs.Ham+2))
+	}
+	return 1 / (1 + math.Exp(-odds)), true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSpamTokenize(t *testing.T) {
+	got := spamTokenize("Buy CHEAP pills, buy now!!! go go-go cheap")
+	want := []string{"buy", "cheap", "pills", "now"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSpamProbability(t *testing.T) {
+	legacyDB(t)
+	migrate(migrations)
+
+	spam := []string{
+		"buy cheap pills online now",
+		"cheap casino bonus click here",
+		"win money fast casino online",
+		"cheap watches buy now discount",
+		"click here for free money",
+	}
+	ham := []string{
+		"how do goroutines share memory",
+		"my rust borrow checker question",
+		"bash script loops over files",
+		"javascript promises and async functions",
+		"golang interfaces and embedding",
+	}
+	train := func(texts []string, spam bool) {
+		for i := 0; i < bayesMinDocs/len(texts); i++ {
+			for _, text := range texts {
+				trainSpam(text, spam)
+			}
+		}
+	}
+
+	// Classifier says nothing until it has seen enough of both kinds
+	train(spam, true)
+	if _, trained := spamProbability("cheap pills"); trained {
+		t.Fatal("classifier is trained without ham texts")
+	}
+	train(ham, false)
+
+	tests := []struct {
+		text    string
+		spam    bool
+		outcome string
+	}{
+		{"buy cheap pills and win casino money, click here", true, filterReject},
+		{"question about golang interfaces and goroutines", false, filterAllow},
+		{"bash loops over javascript files", false, filterAllow},
+	}
+	for _, tt := range tests {
+		p, trained := spamProbability(tt.text)
+		if !trained {
+			t.Fatalf("%q: classifier is not trained", tt.text)
+		}
+		if (p > 0.5) != tt.spam {
+			t.Errorf("%q: spam probability is %s", tt.text, strconv.FormatFloat(p, 'f', 4, 64))
+		}
+		if v := (bayesFilter{}).check(content{Text: tt.text}); v.Outcome != tt.outcome {
+			t.Errorf("%q: filter outcome is %q, want %q", tt.text, v.Outcome, tt.outcome)
+		}
+	}
+
+	// Unknown words alone give prior odds of equally trained classifier
+	if p, _ := spamProbability("zzzz yyyy"); p != 0.5 {
+		t.Errorf("unknown text: spam probability is %v, want 0.5", p)
+	}
+}
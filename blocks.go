@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Muted user's posts, comments and notifications are hidden from the one who
+// muted them. Blocked user is also muted and can't reply to, mention or
+// message the one who blocked them
+const (
+	relationMute  = "mute"
+	relationBlock = "block"
+)
+
+// Condition for hiding authors muted or blocked by user $1, author is given column
+func notMutedBy(column string) string {
+	return column + ` NOT IN (SELECT targetId FROM userBlocks WHERE userId = $1)`
+}
+
+// How user treats another one: muted, blocked or empty string
+func relation(userID, targetID int64) string {
+	var found []struct {
+		Kind string
+	}
+	sliceFromDB(&found, `SELECT kind FROM userBlocks WHERE userId = $1 AND targetId = $2`, nil, userID, targetID)
+	if len(found) == 0 {
+		return ""
+	}
+	return found[0].Kind
+}
+
+// GET lists muted and blocked users, POST {"userID", "kind"} mutes or blocks
+// user, empty kind removes them from the list
+func blocklists(w http.ResponseWriter, r *http.Request) {
+	uid := ctx("user", r).(ctxData).ID
+	if r.Method == http.MethodPost {
+		var req struct {
+			UserID int64  `json:"userID"`
+			Kind   string `json:"kind"`
+		}
+		readBody(r, &req)
+		if req.UserID == uid || (req.Kind != "" && req.Kind != relationMute && req.Kind != relationBlock) {
+			http.Error(w, http.StatusText(400), 400)
+			return
+		}
+		if !isInDB(`SELECT userId FROM users WHERE userId = ?`, req.UserID) {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+		if req.Kind == "" {
+			err(insert(`DELETE FROM userBlocks WHERE userId = $1 AND targetId = $2`, false, uid, req.UserID))
+		} else {
+			query := `INSERT INTO userBlocks(userId, targetId, kind) VALUES ($1, $2, $3)
+				ON CONFLICT(userId, targetId) DO UPDATE SET kind = $3, created = CURRENT_TIMESTAMP`
+			err(insert(query, false, uid, req.UserID, req.Kind))
+		}
+	}
+
+	list := []struct {
+		UserID   int64  `json:"userID"`
+		Username string `json:"username"`
+		Kind     string `json:"kind"`
+		Created  int64  `json:"created"`
+	}{}
+	query := `
+	SELECT b.targetId, COALESCE((SELECT username FROM users u WHERE u.userId = b.targetId), ''), b.kind, CAST(strftime('%s', b.created) AS INT)
+	FROM userBlocks b WHERE b.userId = $1 ORDER BY b.created DESC`
+	sliceFromDB(&list, query, nil, uid)
+	returnJSON(list, w)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Bookmark post or comment {"postID"} or {"commentID"} into folder with note,
+// bookmarking it again moves it or changes note, {"remove": true} deletes it
+func bookmark(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PostID    int64  `json:"postID"`
+		CommentID int64  `json:"commentID"`
+		Folder    string `json:"folder"`
+		Note      string `json:"note"`
+		Remove    bool   `json:"remove"`
+	}
+	readBody(r, &req)
+	uid := ctx("user", r).(ctxData).ID
+
+	if (req.PostID > 0) == (req.CommentID > 0) {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	if req.Remove {
+		query := `DELETE FROM bookmarks WHERE userId = $1 AND commentId = $2 AND ($2 > 0 OR postId = $3)`
+		err(insert(query, false, uid, req.CommentID, req.PostID))
+		return
+	}
+
+	// Comment is bookmarked together with its post
+	var text []struct {
+		PostID int64
+	}
+	query := `SELECT postId FROM posts WHERE status IN (1, 2) AND postId = $1`
+	if req.CommentID > 0 {
+		query = `SELECT postId FROM comments WHERE status IN (1, 2) AND commentId = $1`
+	}
+	sliceFromDB(&text, query, nil, req.PostID+req.CommentID)
+	if len(text) == 0 {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	req.Folder = strings.TrimSpace(req.Folder)
+	if regcheck(req.Folder, `^.{0,50}$`) {
+		http.Error(w, "Folder name is too long", 400)
+		return
+	}
+	query = `INSERT INTO bookmarks(userId, postId, commentId, folder, note) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT(userId, postId, commentId) DO UPDATE SET folder = $4, note = $5`
+	err(insert(query, false, uid, text[0].PostID, req.CommentID, req.Folder, req.Note))
+}
+
+// Bookmarks of current user, newest first, ?folder= filters by folder.
+// Deleted posts and comments are skipped
+func bookmarks(w http.ResponseWriter, r *http.Request) {
+	pageSize := 50
+	page, atoiError := strconv.Atoi(r.FormValue("page"))
+	if atoiError != nil || page <= 0 {
+		page = 1
+	}
+	list := []struct {
+		BookmarkID int64  `json:"id"`
+		Created    int64  `json:"created"`
+		PostID     int64  `json:"postID"`
+		CommentID  int64  `json:"commentID"`
+		Title      string `json:"title"`
+		Comment    string `json:"comment"`
+		AuthorID   int64  `json:"authorID"`
+		Author     string `json:"author"`
+		Folder     string `json:"folder"`
+		Note       string `json:"note"`
+	}{}
+	query := `
+	SELECT
+		b.bookmarkId,
+		CAST(strftime('%s', b.created) AS INT),
+		b.postId,
+		b.commentId,
+		p.title,
+		COALESCE(c.comment, ''),
+		COALESCE(c.userId, p.userId),
+		COALESCE((SELECT username FROM users u WHERE u.userId = COALESCE(c.userId, p.userId)), ''),
+		b.folder,
+		b.note
+	FROM bookmarks b
+	JOIN posts p ON p.postId = b.postId
+	LEFT JOIN comments c ON c.commentId = b.commentId
+	WHERE b.userId = $1 AND b.folder LIKE $2 AND p.status IN (1, 2) AND (b.commentId = 0 OR c.status IN (1, 2))
+	ORDER BY b.bookmarkId DESC LIMIT $3 OFFSET $4`
+	sliceFromDB(&list, query, nil, ctx("user", r).(ctxData).ID, reqQuery("folder", r), pageSize, page*pageSize-pageSize)
+	returnJSON(list, w)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// States of moderation case, reports on the same post or comment are
+// collected into one case until it is actioned or dismissed
+const (
+	caseOpen      = "open"
+	caseReview    = "in-review"
+	caseActioned  = "actioned"
+	caseDismissed = "dismissed"
+)
+
+// Actions moderator can take when case is actioned
+const (
+	actionHide    = "hide"
+	actionWarn    = "warn"
+	actionSuspend = "suspend"
+)
+
+type claimCase struct {
+	CaseID     int64         `json:"caseID"`
+	Created    int64         `json:"created"`
+	Type       string        `json:"type"`
+	TextID     int64         `json:"textID"`
+	PostID     int64         `json:"postID"`
+	AuthorID   int64         `json:"authorID"`
+	Author     string        `json:"author"`
+	State      string        `json:"state"`
+	Assignee   string        `json:"assignee"`
+	Reports    int64         `json:"reports"`
+	Weight     int64         `json:"weight"`
+	Reasons    []interface{} `json:"reasons"`
+	Resolved   int64         `json:"resolved"`
+	Action     string        `json:"action"`
+	Resolution string        `json:"resolution"`
+}
+
+// Columns of claimCase, k is claimCases
+const claimCaseColumns = `
+	k.caseId,
+	CAST(strftime('%s', k.created) AS INT),
+	k.type,
+	k.textId,
+	CASE WHEN k.type = 'post' THEN k.textId ELSE COALESCE((SELECT postId FROM comments c WHERE c.commentId = k.textId), 0) END,
+	COALESCE(CASE WHEN k.type = 'post'
+		THEN (SELECT userId FROM posts p WHERE p.postId = k.textId)
+		ELSE (SELECT userId FROM comments c WHERE c.commentId = k.textId) END, 0),
+	COALESCE(CASE WHEN k.type = 'post'
+		THEN (SELECT username FROM users u JOIN posts p ON p.userId = u.userId WHERE p.postId = k.textId)
+		ELSE (SELECT username FROM users u JOIN comments c ON c.userId = u.userId WHERE c.commentId = k.textId) END, ''),
+	k.state,
+	COALESCE((SELECT username FROM users u WHERE u.userId = k.assignee), ''),
+	(SELECT COUNT(*) FROM claims m WHERE m.caseId = k.caseId),
+	(SELECT COALESCE(SUM(weight), 0) FROM claims m WHERE m.caseId = k.caseId),
+	COALESCE((SELECT GROUP_CONCAT(DISTINCT reason) FROM claims m WHERE m.caseId = k.caseId), ''),
+	COALESCE(CAST(strftime('%s', k.resolved) AS INT), 0),
+	k.action,
+	k.resolution`
+
+func splitReasons(s string) []interface{} {
+	res := []interface{}{}
+	for _, reason := range strings.Split(s, ",") {
+		if reason != "" {
+			res = append(res, reason)
+		}
+	}
+	return res
+}
+
+func validReason(reason string) bool {
+	for _, r := range claimReasons {
+		if reason == r {
+			return true
+		}
+	}
+	return false
+}
+
+// Case of post or comment which is open or in review, 0 if there is none
+func activeCase(typ string, textID int64) int64 {
+	var found []struct {
+		CaseID int64
+	}
+	query := `SELECT caseId FROM claimCases WHERE type = $1 AND textId = $2 AND state IN ($3, $4)`
+	sliceFromDB(&found, query, nil, typ, textID, caseOpen, caseReview)
+	if len(found) == 0 {
+		return 0
+	}
+	return found[0].CaseID
+}
+
+// Live topics of case with reported text in post: "claims" for those who
+// see all cases and "claims:category:ID" for moderators of its categories
+func claimTopics(postID int64) []string {
+	topics := []string{"claims"}
+	for _, id := range textCategories(postID, 0) {
+		topics = append(topics, "claims:category:"+strconv.FormatInt(id, 10))
+	}
+	return topics
+}
+
+func getCase(caseID int64) (claimCase, bool) {
+	var found []claimCase
+	sliceFromDB(&found, `SELECT `+claimCaseColumns+` FROM claimCases k WHERE k.caseId = $1`, splitReasons, caseID)
+	if len(found) == 0 {
+		return claimCase{}, false
+	}
+	return found[0], true
+}
+
+// Moderation queue, heavier cases first. ?state= filters by state ("active"
+// by default, which is open and in review, or "all"), ?assignee= by ID of moderator
+func claimcases(w http.ResponseWriter, r *http.Request) {
+	user := ctx("user", r).(ctxData)
+	if !canSome(user, permClaimView) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	state := r.FormValue("state")
+	if state == "" {
+		state = "active"
+	}
+	assignee, _ := strconv.ParseInt(r.FormValue("assignee"), 10, 64)
+
+	var cases []claimCase
+	query := `SELECT ` + claimCaseColumns + ` FROM claimCases k
+	WHERE ($1 = 'all' OR k.state = $1 OR ($1 = 'active' AND k.state IN ($2, $3)))
+		AND ($4 = 0 OR k.assignee = $4)
+	ORDER BY (SELECT SUM(weight) FROM claims m WHERE m.caseId = k.caseId) DESC, k.caseId`
+	sliceFromDB(&cases, query, splitReasons, state, caseOpen, caseReview, assignee)
+
+	// Category moderators see only cases in their categories
+	visible := []claimCase{}
+	for _, c := range cases {
+		if canText(user, permClaimView, c.PostID, 0) {
+			visible = append(visible, c)
+		}
+	}
+	returnJSON(visible, w)
+}
+
+// Case by ?caseID= with all its reports and moderator notes
+func claimcase(w http.ResponseWriter, r *http.Request) {
+	caseID, _ := strconv.ParseInt(r.FormValue("caseID"), 10, 64)
+	found, ok := getCase(caseID)
+	if !ok {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	if !canText(ctx("user", r).(ctxData), permClaimView, found.PostID, 0) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+
+	var res struct {
+		claimCase
+		Claims []struct {
+			ClaimID  int64  `json:"claimID"`
+			Claimed  int64  `json:"claimed"`
+			Username string `json:"username"`
+			Reason   string `json:"reason"`
+			Claim    string `json:"claim"`
+		} `json:"claims"`
+		Notes []struct {
+			NoteID   int64  `json:"noteID"`
+			Created  int64  `json:"created"`
+			Username string `json:"username"`
+			Note     string `json:"note"`
+		} `json:"notes"`
+	}
+	res.claimCase = found
+	query := `
+	SELECT
+		claimId,
+		CAST(strftime('%s', claimed) AS INT),
+		COALESCE((SELECT username FROM users u WHERE u.userId = c.userId), ''),
+		reason,
+		claim
+	FROM claims c WHERE caseId = $1 ORDER BY claimId`
+	sliceFromDB(&res.Claims, query, nil, caseID)
+	query = `
+	SELECT
+		noteId,
+		CAST(strftime('%s', created) AS INT),
+		COALESCE((SELECT username FROM users u WHERE u.userId = n.userId), ''),
+		note
+	FROM claimNotes n WHERE caseId = $1 ORDER BY noteId`
+	sliceFromDB(&res.Notes, query, nil, caseID)
+	returnJSON(res, w)
+}
+
+// Assign active case to moderator (current one if userID is 0), case goes in review
+func assignclaim(w http.ResponseWriter, r *http.Request) {
+	moderator := ctx("user", r).(ctxData)
+	var req struct {
+		CaseID int64 `json:"caseID"`
+		UserID int64 `json:"userID"`
+	}
+	readBody(r, &req)
+	if req.UserID == 0 {
+		req.UserID = moderator.ID
+	}
+	found, ok := getCase(req.CaseID)
+	if !ok {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	if !canText(moderator, permClaimResolve, found.PostID, 0) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	if !userCan(req.UserID, permClaimResolve, textCategories(found.PostID, 0)...) {
+		http.Error(w, "Assignee can't resolve this case", 400)
+		return
+	}
+	if found.State != caseOpen && found.State != caseReview {
+		http.Error(w, "Case is resolved", http.StatusConflict)
+		return
+	}
+	query := `UPDATE claimCases SET assignee = $1, state = $2 WHERE caseId = $3`
+	err(insert(query, false, req.UserID, caseReview, req.CaseID))
+	assigned, _ := getCase(req.CaseID)
+	audit(r, "claim.assign", "claim", req.CaseID, found, assigned)
+	publish("claim.update", assigned, claimTopics(assigned.PostID)...)
+}
+
+// Internal note of moderator on case, reporters don't see them
+func claimnote(w http.ResponseWriter, r *http.Request) {
+	moderator := ctx("user", r).(ctxData)
+	var req struct {
+		CaseID int64  `json:"caseID"`
+		Note   string `json:"note"`
+	}
+	readBody(r, &req)
+	if strings.TrimSpace(req.Note) == "" {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	found, ok := getCase(req.CaseID)
+	if !ok {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	if !canText(moderator, permClaimResolve, found.PostID, 0) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	err(insert(`INSERT INTO claimNotes(caseId, userId, note) VALUES ($1, $2, $3)`, false, req.CaseID, moderator.ID, req.Note))
+	audit(r, "claim.note", "claim", req.CaseID, nil, req.Note)
+}
+
+// Close case as actioned or dismissed. Actioned case may be linked to action
+// against the content: "hide" deletes it, "warn" notifies its author with
+// the note, "suspend" suspends author with mode and until as /api/suspend
+func resolveclaim(w http.ResponseWriter, r *http.Request) {
+	moderator := ctx("user", r).(ctxData)
+	var req struct {
+		CaseID  int64  `json:"caseID"`
+		Outcome string `json:"outcome"`
+		Action  string `json:"action"`
+		Note    string `json:"note"`
+		Mode    string `json:"mode"`
+		Until   int64  `json:"until"`
+	}
+	readBody(r, &req)
+
+	valid := (req.Outcome == caseDismissed && req.Action == "") ||
+		(req.Outcome == caseActioned && (req.Action == "" || req.Action == actionHide || req.Action == actionWarn || req.Action == actionSuspend))
+	if !valid || (req.Action == actionSuspend && !validSuspension(req.Mode, req.Until)) {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	found, ok := getCase(req.CaseID)
+	if !ok {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	if !canText(moderator, permClaimResolve, found.PostID, 0) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	if found.State != caseOpen && found.State != caseReview {
+		http.Error(w, "Case is resolved", http.StatusConflict)
+		return
+	}
+	if req.Action == actionSuspend {
+		if code := suspendable(moderator, found.AuthorID); code != 0 {
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+	}
+
+	commentID := int64(0)
+	if found.Type == "comment" {
+		commentID = found.TextID
+	}
+	switch req.Action {
+	case actionHide:
+		if found.Type == "post" {
+			before := postSnapshot(found.TextID)
+			trashPost(found.TextID, moderator.ID)
+			audit(r, "post.delete", "post", found.TextID, before, postSnapshot(found.TextID))
+			livePost("post.delete", found.TextID)
+		} else {
+			before := commentSnapshot(found.TextID)
+			trashComment(found.TextID, moderator.ID)
+			audit(r, "comment.delete", "comment", found.TextID, before, commentSnapshot(found.TextID))
+			liveComment("comment.delete", found.TextID)
+		}
+	case actionWarn:
+		notify(found.AuthorID, notifyWarning, moderator.ID, found.PostID, commentID, req.Note)
+		audit(r, "user.warn", "user", found.AuthorID, nil, req.Note)
+	case actionSuspend:
+		before := suspension(found.AuthorID)
+		suspendUser(found.AuthorID, moderator.ID, req.Mode, req.Until, req.Note)
+		audit(r, "user.suspend", "user", found.AuthorID, before, suspension(found.AuthorID))
+	}
+	resolveCase(found, moderator.ID, req.Outcome, req.Action, req.Note)
+	audit(r, "claim.resolve", "claim", found.CaseID, found, caseSnapshot(found.CaseID))
+}
+
+// Save resolution, close reports of case and let each reporter know about it
+func resolveCase(found claimCase, moderatorID int64, state, action, note string) {
+	err(execTx(func(tx *sql.Tx) error {
+		query := `UPDATE claimCases SET state = $1, action = $2, resolution = $3, resolvedBy = $4, resolved = CURRENT_TIMESTAMP WHERE caseId = $5`
+		if _, execError := tx.Exec(query, state, action, note, moderatorID, found.CaseID); execError != nil {
+			return execError
+		}
+		_, execError := tx.Exec(`UPDATE claims SET status = 0 WHERE caseId = $1`, found.CaseID)
+		return execError
+	}))
+
+	var reporters []struct {
+		UserID int64
+	}
+	sliceFromDB(&reporters, `SELECT DISTINCT userId FROM claims WHERE caseId = $1`, nil, found.CaseID)
+	commentID := int64(0)
+	if found.Type == "comment" {
+		commentID = found.TextID
+	}
+	for _, u := range reporters {
+		notify(u.UserID, notifyClaim, moderatorID, found.PostID, commentID, state)
+	}
+
+	// Decisions on spam reports train spam classifier, dismissed ones are ham.
+	// Other reports say nothing about spam
+	spam := false
+	for _, reason := range found.Reasons {
+		spam = spam || reason == "spam"
+	}
+	if spam && (state == caseActioned || state == caseDismissed) {
+		trainSpam(reportedText(found.Type, found.TextID), state == caseActioned)
+	}
+
+	found, _ = getCase(found.CaseID)
+	publish("claim.update", found, claimTopics(found.PostID)...)
+}
@@ -9,6 +9,116 @@ const (
 	tokenRefresh = tokenLife / 2
 	dbname       = "database.db"
 	avatarSize   = 2 * 1024 * 1024 // 2 mb
+
+	// Code highlighting theme and number of highlighted blocks kept in memory
+	highlightStyle     = "github"
+	highlightCacheSize = 1000
+
+	// Most cells of table used to diff revisions (8 bytes each), bigger
+	// changes aren't diffed
+	diffMaxCells = 1 << 20
+
+	// How often background jobs (like publishing scheduled posts) run
+	schedulerInterval = time.Minute
+
+	// Live updates: events queued per client, keep-alive ping interval
+	// and number of recent events kept for clients resuming the stream
+	liveBuffer  = 64
+	livePing    = 30 * time.Second
+	liveLogSize = 1000
+
+	// User is offline and stops viewing post after this time of inactivity
+	presenceTimeout = 5 * time.Minute
+
+	// Emails: directory used instead of SMTP server (see SMTP_* variables),
+	// delivery attempts and delay before the first retry (doubled each time)
+	mailOutbox     = "outbox"
+	mailRetries    = 5
+	mailRetryDelay = time.Minute
+
+	// How often due digests are checked and posts per category in digest
+	digestInterval = time.Hour
+	digestSize     = 5
+
+	// Recent posts and comments shown in user profile
+	profileActivitySize = 10
+
+	// Link confirming new email address works this long
+	emailVerifyLife = 24 * time.Hour
+
+	// Deleted account can be restored by user during this time
+	accountDeleteGrace = 14 * 24 * time.Hour
+
+	// Deleted posts and comments are purged after this time in trash
+	trashRetention = 30 * 24 * time.Hour
+
+	// Content filter: users below trustLinks level can't post more than
+	// newAccountLinks links without review, same text can't be posted again
+	// during duplicateWindow (shorter texts aren't checked)
+	newAccountLinks    = 2
+	duplicateWindow    = 24 * time.Hour
+	duplicateMinLength = 20
+
+	// Spam classifier starts working after it has seen bayesMinDocs spam
+	// and ham texts, text is held or rejected by spam probability
+	bayesMinDocs = 10
+	bayesHold    = 0.9
+	bayesReject  = 0.99
+
+	// Trust levels needed to create posts, upload images and post links
+	trustPost   = 1
+	trustUpload = 1
+	trustLinks  = 2
+
+	// Most members of private conversation, including its creator
+	conversationSize = 20
+
+	// Feed is made of this many recently active posts, ranked ones lose
+	// score with age faster with bigger gravity
+	feedCandidates = 1000
+	feedGravity    = 1.5
+)
+
+// Formats of user fields checked on registration and profile change (and of role names)
+const (
+	usernameFormat = `^[a-zA-Z0-9_]{3,10}$`
+	fullnameFormat = `^.{3,20}$`
+	emailFormat    = `^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`
+
+	// Password also has to fit in 72 bytes used by bcrypt together with
+	// salt, which leaves 53 bytes (characters, if they are ASCII)
+	passwordFormat = `^.{6,}$`
+
+	roleFormat = `^[a-z][a-z0-9_]{1,19}$`
+)
+
+// Interface languages user can choose
+var languages = []string{"en", "ru", "kk"}
+
+// Reasons reporter picks when claiming post or comment
+var claimReasons = []string{"spam", "abuse", "offtopic", "illegal", "other"}
+
+// Number of likes on post or comment which author is notified about
+var reactionMilestones = []int64{1, 10, 25, 50, 100, 500, 1000}
+
+// Trust levels 1, 2 and 3 need days since registration, published texts
+// (posts and comments together), posts, comments and likes received. Each
+// actioned report on user's texts and each suspension takes one level away
+var trustRequirements = []struct{ Days, Texts, Posts, Comments, Likes int64 }{
+	{1, 1, 0, 0, 0},
+	{7, 0, 3, 10, 5},
+	{30, 0, 10, 50, 25},
+}
+
+// Weight of report by trust level of reporter, moderation queue shows heavier cases first
+var trustReportWeight = []int64{1, 2, 3, 5}
+
+// Post status values: 1 and 2 are published, 0 is deleted
+// Posts and comments held by content filter wait for moderator review
+const (
+	statusDeleted = 0
+	statusDraft   = 3
+	statusHeld    = 4
 )
 
 const initialQuery = `
@@ -109,3 +219,329 @@ INSERT INTO categories(name, description)
 
 
 `
+
+// Schema changes applied on top of initialQuery (see migrate in "easyDB.go").
+// Applied entries are counted in DB - never edit or reorder them, only append.
+var migrations = []string{
+
+	// 1. Post and comment edit history
+	`
+CREATE TABLE postRevisions (
+	revisionId INTEGER PRIMARY KEY AUTOINCREMENT,
+	edited DATETIME DEFAULT CURRENT_TIMESTAMP,
+	postId INTEGER NOT NULL,
+	editorId INTEGER NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	title TEXT NOT NULL,
+	text TEXT NOT NULL,
+	categories TEXT NOT NULL );
+
+CREATE TABLE commentRevisions (
+	revisionId INTEGER PRIMARY KEY AUTOINCREMENT,
+	edited DATETIME DEFAULT CURRENT_TIMESTAMP,
+	commentId INTEGER NOT NULL,
+	editorId INTEGER NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	comment TEXT NOT NULL );
+
+INSERT INTO postRevisions(edited, postId, editorId, title, text, categories)
+	SELECT posted, postId, userId, title, text, categories FROM posts;
+
+INSERT INTO commentRevisions(edited, commentId, editorId, comment)
+	SELECT commented, commentId, userId, comment FROM comments;
+`,
+
+	// 2. Markdown source is kept in text columns, rendered HTML next to it
+	`
+ALTER TABLE posts ADD COLUMN html TEXT NOT NULL DEFAULT '';
+ALTER TABLE comments ADD COLUMN html TEXT NOT NULL DEFAULT '';
+
+UPDATE comments SET comment = REPLACE(comment, '<br>', char(10));
+UPDATE commentRevisions SET comment = REPLACE(comment, '<br>', char(10));
+`,
+
+	// 3. Re-render everything with highlighted code blocks
+	`
+UPDATE posts SET html = '';
+UPDATE comments SET html = '';
+`,
+
+	// 4. Scheduled publishing time of draft posts
+	`
+ALTER TABLE posts ADD COLUMN publishAt DATETIME;
+`,
+
+	// 5. Pinned (globally if pinCategory is 0), locked and announcement posts
+	`
+ALTER TABLE posts ADD COLUMN pinned INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE posts ADD COLUMN pinCategory INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE posts ADD COLUMN pinUntil DATETIME;
+ALTER TABLE posts ADD COLUMN locked INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE posts ADD COLUMN announcement INTEGER NOT NULL DEFAULT 0;
+`,
+
+	// 6. Per user settings and preferences as name-value pairs
+	`
+CREATE TABLE settings (
+	userId INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (userId, name) );
+`,
+
+	// 7. Notifications and replies to comments
+	`
+CREATE TABLE notifications (
+	notificationId INTEGER PRIMARY KEY AUTOINCREMENT,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP,
+	userId INTEGER NOT NULL,
+	type TEXT NOT NULL,
+	actorId INTEGER NOT NULL DEFAULT 0,
+	postId INTEGER NOT NULL DEFAULT 0,
+	commentId INTEGER NOT NULL DEFAULT 0,
+	text TEXT NOT NULL DEFAULT '',
+	read INTEGER NOT NULL DEFAULT 0 );
+
+CREATE INDEX notificationsByUser ON notifications(userId, read);
+
+ALTER TABLE comments ADD COLUMN parentId INTEGER NOT NULL DEFAULT 0;
+`,
+
+	// 8. Users mentioned in posts and comments (commentId is 0 for post itself)
+	`
+CREATE TABLE mentions (
+	postId INTEGER NOT NULL,
+	commentId INTEGER NOT NULL DEFAULT 0,
+	userId INTEGER NOT NULL,
+	PRIMARY KEY (postId, commentId, userId) );
+
+CREATE INDEX mentionsByUser ON mentions(userId);
+`,
+
+	// 9. Email queue and categories subscribed for digests
+	`
+CREATE TABLE mailQueue (
+	mailId INTEGER PRIMARY KEY AUTOINCREMENT,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP,
+	recipient TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	text TEXT NOT NULL,
+	html TEXT NOT NULL,
+	unsubscribe TEXT NOT NULL DEFAULT '',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	nextTry DATETIME DEFAULT CURRENT_TIMESTAMP,
+	sent DATETIME,
+	error TEXT NOT NULL DEFAULT '' );
+
+CREATE INDEX mailQueueDue ON mailQueue(sent, nextTry);
+
+CREATE TABLE categorySubscriptions (
+	userId INTEGER NOT NULL,
+	categoryId INTEGER NOT NULL,
+	PRIMARY KEY (userId, categoryId) );
+`,
+
+	// 10. Timezone of user
+	`
+ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT 'UTC';
+`,
+
+	// 11. Suspensions of users, until is NULL for permanent ones
+	`
+CREATE TABLE suspensions (
+	suspensionId INTEGER PRIMARY KEY AUTOINCREMENT,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP,
+	userId INTEGER NOT NULL,
+	moderatorId INTEGER NOT NULL,
+	mode TEXT NOT NULL,
+	until DATETIME,
+	reason TEXT NOT NULL DEFAULT '',
+	lifted DATETIME,
+	liftedBy INTEGER NOT NULL DEFAULT 0 );
+
+CREATE INDEX suspensionsByUser ON suspensions(userId, lifted);
+`,
+
+	// 12. Moderation cases, reports on the same post or comment are grouped into one case
+	`
+ALTER TABLE claims ADD COLUMN reason TEXT NOT NULL DEFAULT 'other';
+ALTER TABLE claims ADD COLUMN caseId INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE claimCases (
+	caseId INTEGER PRIMARY KEY AUTOINCREMENT,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP,
+	type TEXT NOT NULL,
+	textId INTEGER NOT NULL,
+	state TEXT NOT NULL DEFAULT 'open',
+	assignee INTEGER NOT NULL DEFAULT 0,
+	resolvedBy INTEGER NOT NULL DEFAULT 0,
+	resolved DATETIME,
+	resolution TEXT NOT NULL DEFAULT '',
+	action TEXT NOT NULL DEFAULT '' );
+
+CREATE INDEX claimCasesByText ON claimCases(type, textId, state);
+
+CREATE TABLE claimNotes (
+	noteId INTEGER PRIMARY KEY AUTOINCREMENT,
+	caseId INTEGER NOT NULL,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP,
+	userId INTEGER NOT NULL,
+	note TEXT NOT NULL );
+
+INSERT INTO claimCases(created, type, textId, state)
+SELECT MIN(claimed), type, textId, CASE WHEN MAX(status) > 0 THEN 'open' ELSE 'dismissed' END
+FROM claims GROUP BY type, textId;
+
+UPDATE claims SET caseId = (SELECT caseId FROM claimCases k WHERE k.type = claims.type AND k.textId = claims.textId);
+`,
+
+	// 13. Roles with space separated permissions and moderators of categories
+	// Roles given by changerole before are kept without permissions
+	`
+CREATE TABLE roles (
+	role TEXT PRIMARY KEY,
+	permissions TEXT NOT NULL DEFAULT '' );
+
+INSERT INTO roles(role, permissions) VALUES
+	('admin', ''),
+	('moderator', 'post.edit.any comment.edit.any post.moderate revision.rollback claim.view claim.resolve user.suspend user.private'),
+	('user', '');
+
+INSERT OR IGNORE INTO roles(role) SELECT DISTINCT role FROM users;
+
+CREATE TABLE categoryModerators (
+	userId INTEGER NOT NULL,
+	categoryId INTEGER NOT NULL,
+	PRIMARY KEY (userId, categoryId) );
+`,
+
+	// 14. Audit log of privileged actions, rows can't be changed or deleted
+	`
+CREATE TABLE auditLog (
+	entryId INTEGER PRIMARY KEY AUTOINCREMENT,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP,
+	actorId INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	targetType TEXT NOT NULL,
+	targetId INTEGER NOT NULL,
+	before TEXT NOT NULL DEFAULT '',
+	after TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '' );
+
+CREATE INDEX auditLogByActor ON auditLog(actorId);
+CREATE INDEX auditLogByTarget ON auditLog(targetType, targetId);
+
+CREATE TRIGGER auditLogNoUpdate BEFORE UPDATE ON auditLog
+BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;
+
+CREATE TRIGGER auditLogNoDelete BEFORE DELETE ON auditLog
+BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;
+`,
+
+	// 15. Trash: who deleted post or comment, when, and its status before that
+	`
+ALTER TABLE posts ADD COLUMN deletedBy INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE posts ADD COLUMN deleted DATETIME;
+ALTER TABLE posts ADD COLUMN prevStatus INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE comments ADD COLUMN deletedBy INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE comments ADD COLUMN deleted DATETIME;
+ALTER TABLE comments ADD COLUMN prevStatus INTEGER NOT NULL DEFAULT 1;
+`,
+
+	// 16. Content filter: blocklist, token counts of spam classifier (row with
+	// empty token counts texts) and reason why post or comment is held
+	`
+CREATE TABLE blocklist (
+	blockId INTEGER PRIMARY KEY AUTOINCREMENT,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP,
+	pattern TEXT NOT NULL,
+	regex INTEGER NOT NULL DEFAULT 0,
+	outcome TEXT NOT NULL DEFAULT 'reject' );
+
+CREATE TABLE spamTokens (
+	token TEXT PRIMARY KEY,
+	spam INTEGER NOT NULL DEFAULT 0,
+	ham INTEGER NOT NULL DEFAULT 0 );
+
+INSERT INTO spamTokens(token) VALUES ('');
+
+ALTER TABLE posts ADD COLUMN heldReason TEXT NOT NULL DEFAULT '';
+ALTER TABLE comments ADD COLUMN heldReason TEXT NOT NULL DEFAULT '';
+`,
+
+	// 17. Trust level set by admin (NULL is computed one) and weight of report
+	`
+ALTER TABLE users ADD COLUMN trustLevel INTEGER;
+ALTER TABLE claims ADD COLUMN weight INTEGER NOT NULL DEFAULT 1;
+`,
+
+	// 18. Users muted or blocked by others
+	`
+CREATE TABLE userBlocks (
+	userId INTEGER NOT NULL,
+	targetId INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (userId, targetId) );
+`,
+
+	// 19. Private conversations, lastRead is ID of last message member has read
+	`
+CREATE TABLE conversations (
+	conversationId INTEGER PRIMARY KEY AUTOINCREMENT,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP,
+	creatorId INTEGER NOT NULL,
+	title TEXT NOT NULL DEFAULT '' );
+
+CREATE TABLE conversationMembers (
+	conversationId INTEGER NOT NULL,
+	userId INTEGER NOT NULL,
+	lastRead INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (conversationId, userId) );
+
+CREATE INDEX conversationMembersByUser ON conversationMembers(userId);
+
+CREATE TABLE messages (
+	messageId INTEGER PRIMARY KEY AUTOINCREMENT,
+	conversationId INTEGER NOT NULL,
+	userId INTEGER NOT NULL,
+	sent DATETIME DEFAULT CURRENT_TIMESTAMP,
+	text TEXT NOT NULL,
+	html TEXT NOT NULL,
+	attachment TEXT NOT NULL DEFAULT '' );
+
+CREATE INDEX messagesByConversation ON messages(conversationId, messageId);
+`,
+
+	// 20. Bookmarked posts and comments, commentId is 0 for post
+	`
+CREATE TABLE bookmarks (
+	bookmarkId INTEGER PRIMARY KEY AUTOINCREMENT,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP,
+	userId INTEGER NOT NULL,
+	postId INTEGER NOT NULL,
+	commentId INTEGER NOT NULL DEFAULT 0,
+	folder TEXT NOT NULL DEFAULT '',
+	note TEXT NOT NULL DEFAULT '',
+	UNIQUE (userId, postId, commentId) );
+`,
+
+	// 21. Followed posts and users (categories are followed by subscriptions)
+	// and when user has seen post last time
+	`
+CREATE TABLE follows (
+	userId INTEGER NOT NULL,
+	targetId INTEGER NOT NULL,
+	type TEXT NOT NULL,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (userId, type, targetId) );
+
+CREATE INDEX followsByTarget ON follows(type, targetId);
+
+CREATE TABLE postReads (
+	userId INTEGER NOT NULL,
+	postId INTEGER NOT NULL,
+	seen DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (userId, postId) );
+`,
+}
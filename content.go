@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
+)
+
+// Markdown parser with GitHub flavour (tables, strikethrough, autolinks)
+// Raw HTML is passed through on purpose - sanitizer decides what stays
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM, mentionExtension{}),
+	goldmark.WithRendererOptions(
+		html.WithHardWraps(),
+		html.WithUnsafe(),
+		renderer.WithNodeRenderers(util.Prioritized(codeRenderer{}, 200)),
+	),
+)
+
+// Allow-list of tags and attributes safe for user generated content
+// plus CSS classes of highlighted code - only the ones chroma emits,
+// so users can not style their text as mention or other part of the page
+var sanitizer = func() *bluemonday.Policy {
+	var classes []string
+	for _, class := range chroma.StandardTypes {
+		if class != "" {
+			classes = append(classes, regexp.QuoteMeta(class))
+		}
+	}
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^` + chroma.StandardTypes[chroma.PreWrapper] + `$`)).OnElements("pre")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(` + strings.Join(classes, "|") + `)$`)).OnElements("span")
+	return p
+}()
+
+// Class based HTML, colors come from stylesheet served by highlightcss
+var codeFormatter = chromahtml.New(chromahtml.WithClasses(true))
+
+// Render users markdown source to sanitized HTML
+func renderMarkdown(source string) string {
+	var buf bytes.Buffer
+	err(markdown.Convert([]byte(source), &buf))
+	html := sanitizer.Sanitize(buf.String())
+	return strings.ReplaceAll(html, mentionMark, `class="mention"`)
+}
+
+// Render posts and comments which have no HTML yet (written before markdown support)
+func renderMissing() {
+	var posts []struct {
+		ID   int64
+		Text string
+	}
+	sliceFromDB(&posts, `SELECT postId, text FROM posts WHERE html = '' AND text != ''`, nil)
+	for _, p := range posts {
+		err(insert(`UPDATE posts SET html = $1 WHERE postId = $2`, false, renderMarkdown(p.Text), p.ID))
+	}
+
+	var comments []struct {
+		ID      int64
+		Comment string
+	}
+	sliceFromDB(&comments, `SELECT commentId, comment FROM comments WHERE html = '' AND comment != ''`, nil)
+	for _, c := range comments {
+		err(insert(`UPDATE comments SET html = $1 WHERE commentId = $2`, false, renderMarkdown(c.Comment), c.ID))
+	}
+}
+
+// Goldmark renderer which replaces fenced code blocks with highlighted ones
+type codeRenderer struct{}
+
+func (codeRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, renderCode)
+}
+
+func renderCode(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	block := node.(*ast.FencedCodeBlock)
+	var code bytes.Buffer
+	for i := 0; i < block.Lines().Len(); i++ {
+		line := block.Lines().At(i)
+		code.Write(line.Value(source))
+	}
+	_, writeError := w.WriteString(highlight(string(block.Language(source)), code.String()))
+	return ast.WalkSkipChildren, writeError
+}
+
+// Already highlighted blocks by language and code, so re-rendering
+// edited posts does not tokenize every unchanged block again
+var highlighted = struct {
+	sync.Mutex
+	blocks map[[sha256.Size]byte]string
+}{blocks: make(map[[sha256.Size]byte]string)}
+
+// Highlight code block, unknown languages are only escaped
+func highlight(lang, code string) string {
+	key := sha256.Sum256([]byte(lang + "\x00" + code))
+	highlighted.Lock()
+	block, ok := highlighted.blocks[key]
+	highlighted.Unlock()
+	if ok {
+		return block
+	}
+
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	tokens, tokenizeError := chroma.Coalesce(lexer).Tokenise(nil, code)
+	err(tokenizeError)
+	var buf bytes.Buffer
+	err(codeFormatter.Format(&buf, styles.Get(highlightStyle), tokens))
+	block = buf.String()
+
+	highlighted.Lock()
+	if len(highlighted.blocks) >= highlightCacheSize {
+		highlighted.blocks = make(map[[sha256.Size]byte]string)
+	}
+	highlighted.blocks[key] = block
+	highlighted.Unlock()
+	return block
+}
+
+// Stylesheet for highlighted code blocks
+func highlightcss(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	err(codeFormatter.WriteCSS(w, styles.Get(highlightStyle)))
+}
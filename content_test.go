@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdownSanitizes(t *testing.T) {
+	tests := []struct {
+		name      string
+		source    string
+		forbidden []string
+	}{
+		{"script tag", "hi <script>alert(1)</script>", []string{"<script", "alert(1)"}},
+		{"javascript link", "[x](javascript:alert(1))", []string{"javascript:"}},
+		{"javascript raw link", `<a href="javascript:alert(1)">x</a>`, []string{"javascript:"}},
+		{"data link", "[x](data:text/html;base64,PHNjcmlwdD4=)", []string{"data:"}},
+		{"data image", `<img src="data:image/svg+xml;base64,PHN2Zz4=">`, []string{"data:"}},
+		{"event handler", `<img src="/images/1.png" onerror="alert(1)">`, []string{"onerror", "alert(1)"}},
+		{"event handler on div", `<div onclick="alert(1)">x</div>`, []string{"onclick"}},
+		{"style attribute", `<p style="background:url(javascript:alert(1))">x</p>`, []string{"style", "javascript:"}},
+		{"iframe", `<iframe src="https://example.com"></iframe>`, []string{"<iframe"}},
+		{"class on link", `<a href="/" class="evil">x</a>`, []string{"evil"}},
+		{"mention class on link", `<a href="/" class="mention">x</a>`, []string{"mention"}},
+		{"mention class on span", `<span class="mention">x</span>`, []string{"mention"}},
+		{"unknown class on span", `<span class="evil">x</span>`, []string{"evil"}},
+		{"several classes on span", `<span class="kd evil">x</span>`, []string{"class"}},
+		{"class on code", `<code class="evil">x</code>`, []string{"evil"}},
+	}
+	for _, tt := range tests {
+		html := renderMarkdown(tt.source)
+		for _, f := range tt.forbidden {
+			if strings.Contains(strings.ToLower(html), f) {
+				t.Errorf("%s: %q is rendered as %q containing %q", tt.name, tt.source, html, f)
+			}
+		}
+	}
+}
+
+func TestRenderMarkdownKeepsCodeClasses(t *testing.T) {
+	html := renderMarkdown("```go\nfunc main() {}\n```")
+	for _, want := range []string{`<pre class="chroma">`, `<span class="kd">func</span>`, `<span class="nf">main</span>`} {
+		if !strings.Contains(html, want) {
+			t.Errorf("highlighted code %q has no %q", html, want)
+		}
+	}
+}
+
+func TestRenderMarkdownMentions(t *testing.T) {
+	legacyDB(t)
+	migrate(migrations)
+	loadRoles()
+
+	html := renderMarkdown("hi @azakost and @nobody")
+	for _, want := range []string{`href="#/profile?username=azakost"`, `class="mention"`, `>@azakost</a>`} {
+		if !strings.Contains(html, want) {
+			t.Errorf("mention %q has no %q", html, want)
+		}
+	}
+	if strings.Count(html, "mention") != 1 || strings.Contains(html, "title=") {
+		t.Errorf("only existing user is mentioned, got %q", html)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// Save draft without full validation of writepost, so unfinished post is not lost
+// Returns ID of draft which client sends back on next autosave
+func autosave(w http.ResponseWriter, r *http.Request) {
+	var draft struct {
+		PostID     int64   `json:"postID"`
+		Title      string  `json:"title"`
+		Text       string  `json:"text"`
+		Categories []int64 `json:"categories"`
+		PublishAt  int64   `json:"publishAt"`
+	}
+	readBody(r, &draft)
+
+	cats, catsError := processCategories(draft.Categories)
+	if catsError != nil || len(draft.Categories) > 3 {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	uid := ctx("user", r).(ctxData).ID
+	if draft.PostID == 0 && !trusted(w, uid, trustPost) {
+		return
+	}
+	html := renderMarkdown(draft.Text)
+	id := draft.PostID
+
+	e := execTx(func(tx *sql.Tx) error {
+		if id == 0 {
+			ins := `INSERT INTO posts(title, text, html, categories, userId, status, publishAt)
+				values($1, $2, $3, $4, $5, $6, CASE WHEN $7 > 0 THEN datetime($7, 'unixepoch') END)`
+			res, insError := tx.Exec(ins, draft.Title, draft.Text, html, cats, uid, statusDraft, draft.PublishAt)
+			if insError != nil {
+				return insError
+			}
+			id, insError = res.LastInsertId()
+			return insError
+		}
+
+		// Autosave never touches published posts
+		upd := `UPDATE posts SET
+			title = $1,
+			text = $2,
+			html = $3,
+			categories = $4,
+			publishAt = CASE WHEN $5 > 0 THEN datetime($5, 'unixepoch') END
+			WHERE postId = $6 AND userId = $7 AND status = 3`
+		res, updError := tx.Exec(upd, draft.Title, draft.Text, html, cats, draft.PublishAt, id, uid)
+		if updError != nil {
+			return updError
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+
+	if e == sql.ErrNoRows {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	err(e)
+
+	var saved struct {
+		PostID int64 `json:"postID"`
+	}
+	saved.PostID = id
+	returnJSON(saved, w)
+}
+
+// List drafts and scheduled posts of current user
+func drafts(w http.ResponseWriter, r *http.Request) {
+	var drafts []struct {
+		PostID     int64         `json:"pid"`
+		Created    int64         `json:"created"`
+		PublishAt  int64         `json:"publishAt"`
+		Title      string        `json:"title"`
+		Text       string        `json:"text"`
+		Categories []interface{} `json:"categories"`
+	}
+	query := `
+	SELECT
+		postId,
+		CAST(strftime('%s', posted) AS INT),
+		COALESCE(CAST(strftime('%s', publishAt) AS INT), 0),
+		title,
+		text,
+		categories
+	FROM posts WHERE status = 3 AND userId = $1 ORDER BY posted DESC`
+	sliceFromDB(&drafts, query, getCats, ctx("user", r).(ctxData).ID)
+	returnJSON(drafts, w)
+}
+
+// Publish scheduled drafts which time has come
+func publishScheduled() {
+	due := `status = 3 AND publishAt IS NOT NULL AND publishAt <= CURRENT_TIMESTAMP`
+	var posts []struct {
+		ID       int64
+		AuthorID int64
+		Role     string
+		Title    string
+		Text     string
+	}
+	query := `SELECT postId, userId, COALESCE((SELECT role FROM users u WHERE u.userId = posts.userId), ''), title, text FROM posts WHERE ` + due
+	sliceFromDB(&posts, query, nil)
+	if len(posts) == 0 {
+		return
+	}
+
+	// Autosaved drafts skip content filter, so it runs on publication.
+	// Nobody gets rejection here, such posts are held for review too
+	held := make(map[int64]bool)
+	for _, p := range posts {
+		filtered := filterContent(ctxData{p.AuthorID, p.Role}, content{Kind: "post", ID: p.ID, Title: p.Title, Text: p.Text})
+		if filtered.Outcome != filterAllow {
+			held[p.ID] = true
+			query = `UPDATE posts SET status = $1, heldReason = $2 WHERE postId = $3`
+			err(insert(query, false, statusHeld, filtered.Reason, p.ID))
+		}
+	}
+
+	// Only selected posts are published, ones getting due meanwhile wait
+	// for the next run to go through content filter
+	published := make(map[int64]bool)
+	err(execTx(func(tx *sql.Tx) error {
+		for _, p := range posts {
+			if held[p.ID] {
+				continue
+			}
+			res, execError := tx.Exec(`UPDATE posts SET status = 1, posted = publishAt WHERE postId = $1 AND `+due, p.ID)
+			if execError != nil {
+				return execError
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				continue
+			}
+			published[p.ID] = true
+
+			// Published state is the first revision of post
+			rev := `INSERT INTO postRevisions(postId, editorId, title, text, categories)
+				SELECT postId, userId, title, text, categories FROM posts WHERE postId = $1`
+			if _, execError = tx.Exec(rev, p.ID); execError != nil {
+				return execError
+			}
+		}
+		return nil
+	}))
+
+	for _, p := range posts {
+		if published[p.ID] {
+			saveMentions(p.ID, 0, p.AuthorID, p.Text)
+			livePost("post.new", p.ID)
+		}
+	}
+}
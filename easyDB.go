@@ -30,6 +30,32 @@ func createDB(initialQuery string) {
 	}
 }
 
+// Apply schema changes from the list which are not yet recorded in DB
+func migrate(migrations []string) {
+	table := `CREATE TABLE IF NOT EXISTS migrations (
+		version INTEGER PRIMARY KEY,
+		applied DATETIME DEFAULT CURRENT_TIMESTAMP )`
+	err(execQuery(table))
+
+	var applied []struct {
+		Count int64
+	}
+	sliceFromDB(&applied, `SELECT COUNT(*) FROM migrations`, nil)
+
+	for i := int(applied[0].Count); i < len(migrations); i++ {
+		version := i + 1
+		query := migrations[i]
+		err(execTx(func(tx *sql.Tx) error {
+			_, execError := tx.Exec(query)
+			if execError != nil {
+				return execError
+			}
+			_, execError = tx.Exec(`INSERT INTO migrations(version) VALUES ($1)`, version)
+			return execError
+		}))
+	}
+}
+
 // Function for INSERT OR CREATE queries
 func execQuery(query string, args ...interface{}) error {
 	db, databaseError := sql.Open("sqlite3", dbname)
@@ -57,6 +83,21 @@ func insert(query string, condition bool, args ...interface{}) error {
 	return nil
 }
 
+// Run several dependent queries in one transaction, rollback all if fn fails
+func execTx(fn func(tx *sql.Tx) error) error {
+	db, databaseError := sql.Open("sqlite3", dbname)
+	err(databaseError)
+	defer db.Close()
+	tx, txError := db.Begin()
+	err(txError)
+	fnError := fn(tx)
+	if fnError != nil {
+		err(tx.Rollback())
+		return fnError
+	}
+	return tx.Commit()
+}
+
 func sliceFromDB(model interface{}, query string, fn func(s string) []interface{}, args ...interface{}) {
 	db, databaseError := sql.Open("sqlite3", dbname)
 	err(databaseError)
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// Fresh DB of the first version in temporary directory, removed after test
+func legacyDB(t *testing.T) {
+	dir, wdError := os.Getwd()
+	if wdError != nil {
+		t.Fatal(wdError)
+	}
+	if chdirError := os.Chdir(t.TempDir()); chdirError != nil {
+		t.Fatal(chdirError)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+	createDB(initialQuery)
+}
+
+// Comments written before markdown support had line breaks stored as <br>
+// and were shown as HTML, migrated ones must look the same
+func TestMigrateLegacyComments(t *testing.T) {
+	legacyDB(t)
+	legacy := []string{
+		"single line",
+		"first line<br>second line",
+		"one<br>two<br>three",
+	}
+	err(insert(`INSERT INTO posts(userId, title, text, categories) VALUES (1, 'title', 'text', '[]')`, false))
+	for _, c := range legacy {
+		err(insert(`INSERT INTO comments(postId, userId, comment) VALUES (1, 1, $1)`, false, c))
+	}
+
+	migrate(migrations)
+	renderMissing()
+
+	var comments []struct {
+		Comment string
+		HTML    string
+	}
+	sliceFromDB(&comments, `SELECT comment, html FROM comments ORDER BY commentId`, nil)
+	if len(comments) != len(legacy) {
+		t.Fatalf("got %d comments, want %d", len(comments), len(legacy))
+	}
+	for i, c := range comments {
+		if strings.Contains(c.Comment, "<br>") {
+			t.Errorf("source of %q still has <br>: %q", legacy[i], c.Comment)
+		}
+		shown := strings.NewReplacer("<p>", "", "</p>", "", "\n", "").Replace(c.HTML)
+		if shown != legacy[i] {
+			t.Errorf("%q is rendered as %q after migration", legacy[i], c.HTML)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+// Diff of texts differing in too many lines is replaced by this marker
+const diffTooLarge = "too large to diff"
+
+type diffOp struct {
+	kind byte
+	line string
+	x, y int // line numbers in old and new text where op starts
+}
+
+// Line by line unified diff between two texts, empty string if texts are equal
+func unifiedDiff(fromName, toName, from, to string) string {
+	ops, ok := diffLines(strings.Split(from, "\n"), strings.Split(to, "\n"))
+	if !ok {
+		return diffTooLarge
+	}
+
+	// Indexes of changed lines
+	var changes []int
+	for i, op := range ops {
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	out.WriteString("--- " + fromName + "\n")
+	out.WriteString("+++ " + toName + "\n")
+
+	for c := 0; c < len(changes); {
+
+		// Glue together changes which context lines overlap
+		start := changes[c] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		last := changes[c]
+		for c++; c < len(changes) && changes[c]-last <= 2*diffContext; c++ {
+			last = changes[c]
+		}
+		end := last + diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		var oldLen, newLen int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				oldLen++
+			}
+			if op.kind != '-' {
+				newLen++
+			}
+		}
+		oldStart, newStart := ops[start].x+1, ops[start].y+1
+		if oldLen == 0 {
+			oldStart--
+		}
+		if newLen == 0 {
+			newStart--
+		}
+
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", oldStart, oldLen, newStart, newLen)
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line + "\n")
+		}
+	}
+	return out.String()
+}
+
+// Edit script built on longest common subsequence of lines. Common head and
+// tail are skipped, false is returned if the rest needs more than
+// diffMaxCells of LCS table
+func diffLines(a, b []string) ([]diffOp, bool) {
+	head := 0
+	for head < len(a) && head < len(b) && a[head] == b[head] {
+		head++
+	}
+	tail := 0
+	for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+		tail++
+	}
+	ma, mb := a[head:len(a)-tail], b[head:len(b)-tail]
+	if (len(ma)+1)*(len(mb)+1) > diffMaxCells {
+		return nil, false
+	}
+
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			switch {
+			case ma[i] == mb[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	for i := 0; i < head; i++ {
+		ops = append(ops, diffOp{' ', a[i], i, i})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			ops = append(ops, diffOp{' ', ma[i], head + i, head + j})
+			i++
+			j++
+		case i < len(ma) && (j == len(mb) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', ma[i], head + i, head + j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', mb[j], head + i, head + j})
+			j++
+		}
+	}
+	for k := 0; k < tail; k++ {
+		ops = append(ops, diffOp{' ', a[len(ma)+head+k], len(ma) + head + k, len(mb) + head + k})
+	}
+	return ops, true
+}
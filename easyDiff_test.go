@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	many := func(n int, prefix string) string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = prefix + strconv.Itoa(i)
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	tests := []struct {
+		name     string
+		from, to string
+		want     string
+	}{
+		{"empty", "", "", ""},
+		{"identical", "a\nb\nc", "a\nb\nc", ""},
+		{"from empty", "", "a", "--- old\n+++ new\n@@ -1,1 +1,1 @@\n-\n+a\n"},
+		{"insert only", "a\nb\nc", "a\nb\nx\nc", "--- old\n+++ new\n@@ -1,3 +1,4 @@\n a\n b\n+x\n c\n"},
+		{"delete only", "a\nb\nc", "a\nc", "--- old\n+++ new\n@@ -1,3 +1,2 @@\n a\n-b\n c\n"},
+		{"oversized", many(30000, "a"), many(30000, "b"), diffTooLarge},
+		{"big but similar", many(30000, "a"), many(30000, "a") + "\nend", "--- old\n+++ new\n@@ -29998,3 +29998,4 @@\n a29997\n a29998\n a29999\n+end\n"},
+	}
+	for _, tt := range tests {
+		if got := unifiedDiff("old", "new", tt.from, tt.to); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
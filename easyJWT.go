@@ -3,12 +3,15 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"io"
 	"net/http"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -25,7 +28,53 @@ func cryptIsValid(crypt, data string) bool {
 	return e == nil
 }
 
-var sessions = make(map[int64]string)
+// Token carrying data signed with server secret, for links sent outside
+// of session (like unsubscribe links in emails)
+func sign(data string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString([]byte(data)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Data of signed token, ok is false if token is forged or broken
+func unsign(token string) (data string, ok bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", false
+	}
+	raw, decodeError := base64.RawURLEncoding.DecodeString(parts[0])
+	if decodeError != nil {
+		return "", false
+	}
+	return string(raw), hmac.Equal([]byte(sign(string(raw))), []byte(token))
+}
+
+// Session tokens by user, used by handlers and background jobs at once -
+// access it only with the helpers below
+var (
+	sessions     = make(map[int64]string)
+	sessionsLock sync.Mutex
+)
+
+func getSession(userID int64) (string, bool) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	token, ok := sessions[userID]
+	return token, ok
+}
+
+func setSession(userID int64, token string) {
+	sessionsLock.Lock()
+	sessions[userID] = token
+	sessionsLock.Unlock()
+}
+
+// Log user out everywhere
+func endSession(userID int64) {
+	sessionsLock.Lock()
+	delete(sessions, userID)
+	sessionsLock.Unlock()
+}
 
 type jwt struct {
 	UserID int64     `json:"userID"`
@@ -36,7 +85,12 @@ type jwt struct {
 
 func setJWT(userID int64, role string, w http.ResponseWriter) {
 	exp := time.Now().Add(tokenLife)
-	token := encrypt(strconv.FormatInt(userID, 10) + exp.String())
+
+	// Random session token - JWT is valid only while it matches the one in sessions map
+	raw := make([]byte, 32)
+	_, randError := io.ReadFull(rand.Reader, raw)
+	err(randError)
+	token := base64.StdEncoding.EncodeToString(raw)
 
 	var jTok jwt
 
@@ -60,7 +114,7 @@ func setJWT(userID int64, role string, w http.ResponseWriter) {
 	val := base64.StdEncoding.EncodeToString([]byte(ciphertext))
 
 	// Write JWT to map
-	sessions[userID] = token
+	setSession(userID, token)
 
 	// Add cookie
 	addCookie(w, "jwt", val, exp)
@@ -77,7 +131,7 @@ func validateJWT(w http.ResponseWriter, r *http.Request) (bool, int64, string) {
 	}
 
 	// Check if email exists in sessions map
-	val, ok := sessions[jTok.UserID]
+	val, ok := getSession(jTok.UserID)
 
 	if !ok {
 		addCookie(w, "jwt", "", time.Unix(0, 0))
@@ -87,14 +141,14 @@ func validateJWT(w http.ResponseWriter, r *http.Request) (bool, int64, string) {
 	// Filter 1 - Stright token compare and fail if not equal
 
 	if val != jTok.Token {
-		delete(sessions, jTok.UserID)
+		endSession(jTok.UserID)
 		addCookie(w, "jwt", "", time.Unix(0, 0))
 		return false, 0, ""
 	}
 
 	// Filter 2 - If token is expired
 	if time.Now().After(jTok.Expire) {
-		delete(sessions, jTok.UserID)
+		endSession(jTok.UserID)
 		addCookie(w, "jwt", "", time.Unix(0, 0))
 		return false, 0, ""
 	}
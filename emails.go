@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type digestPost struct {
+	Title    string
+	Username string
+	Link     string
+	Likes    int64
+	Comments int64
+}
+
+type digestCategory struct {
+	Name  string
+	Posts []digestPost
+}
+
+func postLink(postID int64) string {
+	return siteURL() + "/#/posts/" + strconv.FormatInt(postID, 10)
+}
+
+// One-click unsubscribe link, kind is "digest" or "email.<notification type>"
+func unsubscribeLink(userID int64, kind string) string {
+	return siteURL() + "/api/unsubscribe?token=" + sign(strconv.FormatInt(userID, 10)+":"+kind)
+}
+
+// Email about notification, sent only for types user turned on in email preferences
+func mailNotification(userID int64, typ string, actorID, postID, commentID int64, text string) {
+	if setting(userID, "email."+typ, "0") != "1" {
+		return
+	}
+	var user []struct {
+		Username string
+		Email    string
+		Actor    string
+		Title    string
+	}
+	query := `
+	SELECT
+		u.username,
+		u.email,
+		COALESCE((SELECT username FROM users a WHERE a.userId = $1), ''),
+		COALESCE((SELECT title FROM posts p WHERE p.postId = $2), '')
+	FROM users u WHERE u.userId = $3`
+	sliceFromDB(&user, query, nil, actorID, postID, userID)
+	if len(user) == 0 {
+		return
+	}
+
+	var message string
+	switch typ {
+	case notifyPostReply:
+		message = user[0].Actor + " commented on your post"
+	case notifyCommentReply:
+		message = user[0].Actor + " replied to your comment"
+	case notifyMention:
+		message = user[0].Actor + " mentioned you"
+	case notifyMilestone:
+		message = "Your post got " + text
+		if commentID > 0 {
+			message = "Your comment got " + text
+		}
+	case notifyClaim:
+		message = "Your report was reviewed: " + text
+	case notifyRole:
+		message = "Your role was changed to " + text
+	}
+
+	data := mailData{
+		Username:    user[0].Username,
+		Message:     message,
+		Title:       user[0].Title,
+		Link:        postLink(postID),
+		Unsubscribe: unsubscribeLink(userID, "email."+typ),
+	}
+	m := mail{To: user[0].Email, Subject: message, Unsubscribe: data.Unsubscribe}
+	m.Text, m.HTML = renderMail("notification", data)
+	queueMail(m)
+}
+
+// Daily or weekly email with top posts of subscribed categories
+// published since previous digest, nothing is sent if there are no posts
+func sendDigests() {
+	var users []struct {
+		ID       int64
+		Username string
+		Email    string
+		Period   string
+		Last     string
+	}
+	query := `
+	SELECT
+		u.userId,
+		u.username,
+		u.email,
+		s.value,
+		COALESCE((SELECT value FROM settings l WHERE l.userId = u.userId AND l.name = 'digest.last'), '0')
+	FROM users u JOIN settings s ON s.userId = u.userId AND s.name = 'digest'
+	WHERE s.value IN ('daily', 'weekly')`
+	sliceFromDB(&users, query, nil)
+
+	now := time.Now().Unix()
+	for _, u := range users {
+		period := int64(24 * time.Hour / time.Second)
+		if u.Period == "weekly" {
+			period *= 7
+		}
+		last, _ := strconv.ParseInt(u.Last, 10, 64)
+		if last == 0 {
+			last = now - period
+		}
+		if now-last < period {
+			continue
+		}
+		setSetting(u.ID, "digest.last", strconv.FormatInt(now, 10))
+
+		var posts []struct {
+			Category string
+			PostID   int64
+			Title    string
+			Username string
+			Likes    int64
+			Comments int64
+		}
+		query := `
+		SELECT
+			c.name,
+			p.postId,
+			p.title,
+			(SELECT username FROM users u WHERE u.userId = p.userId),
+			(SELECT COUNT(*) FROM postReactions r WHERE r.postId = p.postId AND reaction = 'like') AS likes,
+			(SELECT COUNT(*) FROM comments m WHERE m.postId = p.postId) AS comments
+		FROM categorySubscriptions s
+		JOIN categories c ON c.categoryId = s.categoryId
+		JOIN posts p ON p.categories LIKE '%"' || c.categoryId || '"%'
+		WHERE s.userId = $1 AND p.status IN (1, 2) AND p.posted > datetime($2, 'unixepoch')
+		ORDER BY c.name, likes DESC, comments DESC`
+		sliceFromDB(&posts, query, nil, u.ID, last)
+
+		var cats []digestCategory
+		for _, p := range posts {
+			if len(cats) == 0 || cats[len(cats)-1].Name != p.Category {
+				cats = append(cats, digestCategory{Name: p.Category})
+			}
+			cat := &cats[len(cats)-1]
+			if len(cat.Posts) < digestSize {
+				cat.Posts = append(cat.Posts, digestPost{p.Title, p.Username, postLink(p.PostID), p.Likes, p.Comments})
+			}
+		}
+		if len(cats) == 0 {
+			continue
+		}
+
+		data := mailData{
+			Username:    u.Username,
+			Message:     "Top posts of your " + u.Period + " digest",
+			Categories:  cats,
+			Unsubscribe: unsubscribeLink(u.ID, "digest"),
+		}
+		m := mail{To: u.Email, Subject: "Forum " + u.Period + " digest", Unsubscribe: data.Unsubscribe}
+		m.Text, m.HTML = renderMail("digest", data)
+		queueMail(m)
+	}
+}
+
+func validDigest(period string) bool {
+	return period == "off" || period == "daily" || period == "weekly"
+}
+
+// First digest comes one period after it is turned on
+func setDigest(userID int64, period string) {
+	if period != setting(userID, "digest", "off") {
+		setSetting(userID, "digest", period)
+		setSetting(userID, "digest.last", strconv.FormatInt(time.Now().Unix(), 10))
+	}
+}
+
+// GET returns email preferences, POST changes given ones:
+// {"digest": "off" | "daily" | "weekly", "types": {"mention": true, ...}, "categories": [1, 2]}
+func emailprefs(w http.ResponseWriter, r *http.Request) {
+	uid := ctx("user", r).(ctxData).ID
+	var prefs struct {
+		Digest     string          `json:"digest"`
+		Types      map[string]bool `json:"types"`
+		Categories []int64         `json:"categories"`
+	}
+
+	if r.Method == http.MethodPost {
+		readBody(r, &prefs)
+		if prefs.Digest != "" && !validDigest(prefs.Digest) {
+			http.Error(w, http.StatusText(400), 400)
+			return
+		}
+		if prefs.Categories != nil {
+			if _, catsError := processCategories(prefs.Categories); catsError != nil {
+				http.Error(w, "No such category", 400)
+				return
+			}
+		}
+
+		if prefs.Digest != "" {
+			setDigest(uid, prefs.Digest)
+		}
+		setFlags(uid, "email.", notificationTypes, prefs.Types)
+		if prefs.Categories != nil {
+			err(execTx(func(tx *sql.Tx) error {
+				_, execError := tx.Exec(`DELETE FROM categorySubscriptions WHERE userId = $1`, uid)
+				if execError != nil {
+					return execError
+				}
+				for _, cat := range prefs.Categories {
+					_, execError = tx.Exec(`INSERT OR IGNORE INTO categorySubscriptions(userId, categoryId) VALUES ($1, $2)`, uid, cat)
+					if execError != nil {
+						return execError
+					}
+				}
+				return nil
+			}))
+		}
+	}
+
+	prefs.Digest = setting(uid, "digest", "off")
+	prefs.Types = getFlags(uid, "email.", notificationTypes, false)
+	var cats []struct {
+		ID int64
+	}
+	sliceFromDB(&cats, `SELECT categoryId FROM categorySubscriptions WHERE userId = $1 ORDER BY categoryId`, nil, uid)
+	prefs.Categories = []int64{}
+	for _, c := range cats {
+		prefs.Categories = append(prefs.Categories, c.ID)
+	}
+	returnJSON(prefs, w)
+}
+
+// One-click unsubscribe from email link (GET) or mail client (POST), no login needed
+func unsubscribe(w http.ResponseWriter, r *http.Request) {
+	data, ok := unsign(r.FormValue("token"))
+	parts := strings.SplitN(data, ":", 2)
+	if !ok || len(parts) != 2 {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	uid, _ := strconv.ParseInt(parts[0], 10, 64)
+	kind := parts[1]
+
+	switch {
+	case kind == "digest":
+		setSetting(uid, "digest", "off")
+	case strings.HasPrefix(kind, "email."):
+		setSetting(uid, kind, "0")
+	default:
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, writeError := w.Write([]byte("You are unsubscribed."))
+	err(writeError)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -34,10 +35,10 @@ func register(w http.ResponseWriter, r *http.Request) {
 	}
 	var valid report
 
-	valid.UsernameFormat = regcheck(reg.Username, `^[a-zA-Z0-9_]{3,10}$`)
-	valid.EmailFormat = regcheck(reg.Email, `^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`)
-	valid.FullnameFormat = regcheck(reg.Fullname, `^.{3,20}$`)
-	valid.PasswordFormat = regcheck(reg.Password, `^.{6,}$`)
+	valid.UsernameFormat = regcheck(reg.Username, usernameFormat)
+	valid.EmailFormat = regcheck(reg.Email, emailFormat)
+	valid.FullnameFormat = regcheck(reg.Fullname, fullnameFormat)
+	valid.PasswordFormat = regcheck(reg.Password, passwordFormat) || len(reg.Password+salt) > 72 // bcrypt limit
 
 	// Encrypt password for safe storage
 	pass := encrypt(reg.Password)
@@ -90,6 +91,13 @@ func login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Banned user can't log in
+	if s := suspension(creds[0].UserID); s.Mode == suspendBanned {
+		w.WriteHeader(403)
+		returnJSON(s, w)
+		return
+	}
+
 	// Set new JWT if password correct
 	setJWT(creds[0].UserID, creds[0].Role, w)
 
@@ -107,7 +115,7 @@ func login(w http.ResponseWriter, r *http.Request) {
 }
 
 func logout(w http.ResponseWriter, r *http.Request) {
-	delete(sessions, ctx("user", r).(ctxData).ID)
+	endSession(ctx("user", r).(ctxData).ID)
 	addCookie(w, "jwt", "", time.Unix(0, 0))
 }
 
@@ -120,17 +128,34 @@ func writepost(w http.ResponseWriter, r *http.Request) {
 		Categories []int64 `json:"categories"`
 		PostID     int64   `json:"postID"`
 		Status     int64   `json:"status"`
+		Reason     string  `json:"reason"`
+		Draft      bool    `json:"draft"`
+		PublishAt  int64   `json:"publishAt"`
 	}
 	readBody(r, &post)
 
-	role := ctx("user", r).(ctxData).Role
-	uid := ctx("user", r).(ctxData).ID
+	user := ctx("user", r).(ctxData)
+	uid := user.ID
+
+	// Others can edit post only with permission, such changes are audited
+	editAny := post.PostID != 0 && canText(user, permPostEditAny, post.PostID, 0)
+	moderated := editAny && textAuthor(post.PostID, 0) != uid
+	var before interface{}
+	if moderated {
+		before = postSnapshot(post.PostID)
+	}
 
 	var e error
 	if post.Status == 0 && post.Title == "" && post.PostID != 0 {
-		upd := `UPDATE posts SET status = $1 WHERE postId = $2 AND (userId = $3 OR $4 = 'admin' OR $4 = 'moderator')`
-		e = insert(upd, false, post.Status, post.PostID, uid, role)
-		err(e)
+		if !editAny && textAuthor(post.PostID, 0) != uid {
+			http.Error(w, http.StatusText(403), 403)
+			return
+		}
+		trashPost(post.PostID, uid)
+		if moderated {
+			audit(r, "post.delete", "post", post.PostID, before, postSnapshot(post.PostID))
+		}
+		livePost("post.delete", post.PostID)
 		return
 	}
 
@@ -144,7 +169,8 @@ func writepost(w http.ResponseWriter, r *http.Request) {
 
 	var validity report
 	validity.Title = regcheck(strings.TrimSpace(post.Title), `^.{3,140}$`)
-	validity.Status = (post.Status > 2 || post.Status < 0) && post.PostID != 0
+	// Edit can't delete post (it goes to trash only as above)
+	validity.Status = (post.Status > 2 || post.Status < 1) && post.PostID != 0 && !post.Draft
 	validity.CategoriesNum = len(post.Categories) > 3 || len(post.Categories) == 0
 
 	if (report{}) != validity {
@@ -165,20 +191,115 @@ func writepost(w http.ResponseWriter, r *http.Request) {
 	if strings.TrimSpace(post.Text) != "" {
 		text = post.Text
 	}
+	html := renderMarkdown(text)
 
+	// Everything but drafts goes through content filter. Held post stays
+	// held after editing until moderator reviews it
+	filtered := verdict{Outcome: filterAllow}
+	if !post.Draft {
+		filtered = filterContent(user, content{Kind: "post", ID: post.PostID, Title: post.Title, Text: text})
+	}
+	if filtered.Outcome == filterReject {
+		w.WriteHeader(400)
+		returnJSON(filtered, w)
+		return
+	}
+	wasHeld := post.PostID != 0 && !editAny && isInDB("SELECT postId FROM posts WHERE status = 4 AND postId = ?", post.PostID)
+
+	// Drafts and posts scheduled for future are visible only to author
+	status := post.Status
 	if post.PostID == 0 {
-		ins := `INSERT INTO posts(title, text, categories, userId) values($1, $2, $3, $4)`
-		e = insert(ins, false, post.Title, text, cats, uid)
+		status = 1
+	}
+	if post.Draft || post.PublishAt > time.Now().Unix() {
+		status = statusDraft
 	} else {
-		upd := `UPDATE posts SET 
-			title = $1, 
-			text = $2, 
-			categories = $3,
-			status = $4 
-			WHERE postId = $5 AND (userId = $6 OR $7 = 'admin' OR $7 = 'moderator')`
-		e = insert(upd, false, post.Title, text, cats, post.Status, post.PostID, uid, role)
+		post.PublishAt = 0
+	}
+	held := !post.Draft && (filtered.Outcome == filterHold || wasHeld)
+	if held {
+		status = statusHeld
+	}
+
+	// Draft which becomes published is a new post for live updates
+	id := post.PostID
+	wasDraft := id != 0 && isInDB("SELECT postId FROM posts WHERE status = 3 AND postId = ?", id)
+
+	// Users with low trust level can only comment
+	if (id == 0 || wasDraft) && !trusted(w, uid, trustPost) {
+		return
+	}
+
+	// Write post and its new revision together
+	e = execTx(func(tx *sql.Tx) error {
+		if id == 0 {
+			ins := `INSERT INTO posts(title, text, html, categories, userId, status, publishAt) 
+				values($1, $2, $3, $4, $5, $6, CASE WHEN $7 > 0 THEN datetime($7, 'unixepoch') END)`
+			res, insError := tx.Exec(ins, post.Title, text, html, cats, uid, status, post.PublishAt)
+			if insError != nil {
+				return insError
+			}
+			id, insError = res.LastInsertId()
+			if insError != nil {
+				return insError
+			}
+		} else {
+			upd := `UPDATE posts SET 
+				title = $1, 
+				text = $2, 
+				html = $3,
+				categories = $4,
+				posted = CASE WHEN status = 3 AND $5 != 3 THEN CURRENT_TIMESTAMP ELSE posted END,
+				status = $5,
+				publishAt = CASE WHEN $6 > 0 THEN datetime($6, 'unixepoch') END
+				WHERE postId = $7 AND status != 0 AND (userId = $8 OR ($9 AND status != 3))`
+			res, updError := tx.Exec(upd, post.Title, text, html, cats, status, post.PublishAt, post.PostID, uid, editAny)
+			if updError != nil {
+				return updError
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return sql.ErrNoRows
+			}
+		}
+		if filtered.Outcome == filterHold {
+			_, heldError := tx.Exec(`UPDATE posts SET heldReason = $1 WHERE postId = $2`, filtered.Reason, id)
+			if heldError != nil {
+				return heldError
+			}
+		}
+		if status == statusDraft {
+			return nil
+		}
+		return postRevision(tx, id, uid, post.Reason)
+	})
+
+	// No such post (or it is in trash) or user is not allowed to edit it
+	if e == sql.ErrNoRows {
+		http.Error(w, http.StatusText(403), 403)
+		return
 	}
 	err(e)
+	if moderated {
+		audit(r, "post.edit", "post", id, before, postSnapshot(id))
+	}
+
+	// Held post is published by moderator, mentions and live event wait until then
+	if held {
+		if filtered.Outcome != filterHold {
+			filtered = verdict{filterHold, "waiting for review"}
+		}
+		w.WriteHeader(http.StatusAccepted)
+		returnJSON(filtered, w)
+		return
+	}
+	if status != statusDraft {
+		saveMentions(id, 0, uid, text)
+	}
+	if post.PostID == 0 || wasDraft {
+		livePost("post.new", id)
+	} else {
+		livePost("post.update", id)
+	}
 }
 
 func posts(w http.ResponseWriter, r *http.Request) {
@@ -191,9 +312,10 @@ func posts(w http.ResponseWriter, r *http.Request) {
 	postID := reqQuery("postID", r)
 	byreact := r.FormValue("byreact")
 
-	order := "ORDER BY p.posted DESC"
+	// Pinned posts go first, either pinned globally or in requested category
+	order := "ORDER BY pinned DESC, p.posted DESC"
 	if byreact == "likes" || byreact == "dislikes" {
-		order = "ORDER BY " + byreact + " DESC"
+		order = "ORDER BY pinned DESC, " + byreact + " DESC"
 	}
 
 	// Pagination params
@@ -215,6 +337,10 @@ func posts(w http.ResponseWriter, r *http.Request) {
 		Dislikes   int64         `json:"dislikes"`
 		Comments   int64         `json:"comments"`
 		Reaction   string        `json:"reaction"`
+		Bookmarked int64         `json:"bookmarked"`
+		Pinned     int64         `json:"pinned"`
+		Locked     int64         `json:"locked"`
+		Announce   int64         `json:"announcement"`
 		Categories []interface{} `json:"categories"`
 	}
 	query := `
@@ -228,17 +354,24 @@ func posts(w http.ResponseWriter, r *http.Request) {
 		(SELECT COUNT(*) FROM postReactions r WHERE r.postId = p.postId AND reaction = 'dislike') AS dislikes,
 		(SELECT COUNT(*) FROM comments c WHERE c.postId = p.postId) AS Comments,
 		COALESCE((SELECT reaction FROM postReactions r WHERE r.postId = p.postId AND r.userId = $1), "idle"),
+		(SELECT COUNT(*) FROM bookmarks b WHERE b.postId = p.postId AND b.commentId = 0 AND b.userId = $1),
+		CASE WHEN p.pinned = 1 
+			AND (p.pinUntil IS NULL OR p.pinUntil > CURRENT_TIMESTAMP) 
+			AND (p.pinCategory = 0 OR p.pinCategory = $2) THEN 1 ELSE 0 END AS pinned,
+		p.locked,
+		p.announcement,
 		p.categories
 	FROM posts p WHERE 
-	p.status > '0'
-	AND p.categories LIKE $2 
-	AND p.userId LIKE $3 
-	AND p.title LIKE $4 
-	AND p.postId LIKE $5
-	AND p.status LIKE $6 ` + order + ` LIMIT $7 OFFSET $8`
+	p.status IN (1, 2)
+	AND p.categories LIKE $3 
+	AND p.userId LIKE $4 
+	AND p.title LIKE $5 
+	AND p.postId LIKE $6
+	AND p.status LIKE $7
+	AND ` + notMutedBy("p.userId") + ` ` + order + ` LIMIT $8 OFFSET $9`
 
 	uid := ctx("user", r).(ctxData).ID
-	sliceFromDB(&postDB, query, getCats, uid, cat, userID, search, postID, status, pageSize, offset)
+	sliceFromDB(&postDB, query, getCats, uid, r.FormValue("cat"), cat, userID, search, postID, status, pageSize, offset)
 	returnJSON(postDB, w)
 }
 
@@ -254,9 +387,15 @@ func post(w http.ResponseWriter, r *http.Request) {
 		Username   string
 		Title      string
 		Text       string
+		HTML       string
 		Reaction   string
+		Bookmarked int64
 		Likes      int64
 		Dislikes   int64
+		Edited     int64
+		Pinned     int64
+		Locked     int64
+		Announce   int64
 		Categories []interface{}
 	}
 	query := `
@@ -266,13 +405,27 @@ func post(w http.ResponseWriter, r *http.Request) {
 		(SELECT username FROM users u WHERE u.userId = p.userId),
 		p.title, 
 		p.text,
+		p.html,
 		COALESCE((SELECT reaction FROM postReactions r WHERE r.postId = p.postId AND r.userId = $1), "idle"),
+		(SELECT COUNT(*) FROM bookmarks b WHERE b.postId = p.postId AND b.commentId = 0 AND b.userId = $1),
 		(SELECT COUNT(*) FROM postReactions r WHERE r.postId = p.postId AND reaction = 'like') AS likes,
 		(SELECT COUNT(*) FROM postReactions r WHERE r.postId = p.postId AND reaction = 'dislike') AS dislikes,
+		(SELECT CASE WHEN COUNT(*) > 1 THEN CAST(strftime('%s', MAX(edited)) AS INT) ELSE 0 END FROM postRevisions v WHERE v.postId = p.postId),
+		CASE WHEN p.pinned = 1 AND (p.pinUntil IS NULL OR p.pinUntil > CURRENT_TIMESTAMP) THEN 1 ELSE 0 END,
+		p.locked,
+		p.announcement,
 		p.categories
-	FROM posts p WHERE p.status > '0' AND p.postId = $2`
+	FROM posts p WHERE p.status > '0' AND (p.status NOT IN (3, 4) OR p.userId = $1) AND p.postId = $2`
 	uid := ctx("user", r).(ctxData).ID
 	sliceFromDB(&postDB, query, getCats, uid, postID)
+	if len(postDB) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	viewPost(postDB[0].PostID, viewerKey(r))
+	if uid > 0 {
+		markSeen(uid, postDB[0].PostID)
+	}
 	returnJSON(postDB[0], w)
 
 }
@@ -280,14 +433,17 @@ func post(w http.ResponseWriter, r *http.Request) {
 func comments(w http.ResponseWriter, r *http.Request) {
 	uid := ctx("user", r).(ctxData).ID
 	var comments []struct {
-		CommentID int64  `json:"cid"`
-		Commented int64  `json:"created"`
-		AuthorID  int64  `json:"uid"`
-		Username  string `json:"username"`
-		Comment   string `json:"text"`
-		Like      int64  `json:"likes"`
-		Dislike   int64  `json:"dislikes"`
-		Reaction  string `json:"reaction"`
+		CommentID  int64  `json:"cid"`
+		Commented  int64  `json:"created"`
+		AuthorID   int64  `json:"uid"`
+		Username   string `json:"username"`
+		Comment    string `json:"text"`
+		HTML       string `json:"html"`
+		Like       int64  `json:"likes"`
+		Dislike    int64  `json:"dislikes"`
+		Reaction   string `json:"reaction"`
+		Bookmarked int64  `json:"bookmarked"`
+		Edited     int64  `json:"edited"`
 	}
 	query := `
 	SELECT 
@@ -296,11 +452,15 @@ func comments(w http.ResponseWriter, r *http.Request) {
 		c.userId,
 		(SELECT username FROM users u WHERE u.userId = c.userId),
 		comment,
+		html,
 		(SELECT COUNT(*) FROM commentReactions r WHERE r.commentId = c.commentId AND reaction = 'like'),
 		(SELECT COUNT(*) FROM commentReactions r WHERE r.commentId = c.commentId AND reaction = 'dislike'),
-		COALESCE((SELECT reaction FROM commentReactions r WHERE r.commentId = c.commentId AND r.userId = $1), "idle")
+		COALESCE((SELECT reaction FROM commentReactions r WHERE r.commentId = c.commentId AND r.userId = $1), "idle"),
+		(SELECT COUNT(*) FROM bookmarks b WHERE b.commentId = c.commentId AND b.userId = $1),
+		(SELECT CASE WHEN COUNT(*) > 1 THEN CAST(strftime('%s', MAX(edited)) AS INT) ELSE 0 END FROM commentRevisions v WHERE v.commentId = c.commentId)
 	FROM comments c
-	WHERE c.status > '0' AND c.postId = $2 ORDER BY commented DESC`
+	WHERE c.status > '0' AND (c.status != 4 OR c.userId = $1) AND c.postId = $2 AND ` + notMutedBy("c.userId") + `
+	ORDER BY commented DESC`
 
 	sliceFromDB(&comments, query, nil, uid, r.FormValue("postID"))
 	returnJSON(comments, w)
@@ -312,14 +472,29 @@ func writecomment(w http.ResponseWriter, r *http.Request) {
 		Comment   string `json:"comment"`
 		CommentID int64  `json:"commentID"`
 		Status    int64  `json:"status"`
+		Reason    string `json:"reason"`
+		ReplyTo   int64  `json:"replyTo"`
 	}
 	readBody(r, &comment)
 
-	role := ctx("user", r).(ctxData).Role
-	uid := ctx("user", r).(ctxData).ID
+	user := ctx("user", r).(ctxData)
+	uid := user.ID
+	editAny := comment.CommentID != 0 && canText(user, permCommentEditAny, 0, comment.CommentID)
+	moderated := editAny && textAuthor(0, comment.CommentID) != uid
+	var before interface{}
+	if moderated {
+		before = commentSnapshot(comment.CommentID)
+	}
 	if comment.Status == 0 && comment.Comment == "" {
-		upd := `UPDATE comments SET status = $1 WHERE commentId= $2 AND (userId = $3 OR $4 = 'admin' OR $4 = 'moderator')`
-		err(insert(upd, false, comment.Status, comment.CommentID, uid, role))
+		if !editAny && textAuthor(0, comment.CommentID) != uid {
+			http.Error(w, http.StatusText(403), 403)
+			return
+		}
+		trashComment(comment.CommentID, uid)
+		if moderated {
+			audit(r, "comment.delete", "comment", comment.CommentID, before, commentSnapshot(comment.CommentID))
+		}
+		liveComment("comment.delete", comment.CommentID)
 		return
 	}
 
@@ -328,14 +503,87 @@ func writecomment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newComment := strings.ReplaceAll(comment.Comment, "\n", "<br>")
+	if isLocked(comment.PostID, comment.CommentID) && !canText(user, permPostModerate, comment.PostID, comment.CommentID) {
+		http.Error(w, "Post is locked", http.StatusLocked)
+		return
+	}
+
+	// Users can't reply to those who blocked them
+	if comment.CommentID == 0 && (relation(textAuthor(comment.PostID, 0), uid) == relationBlock ||
+		comment.ReplyTo != 0 && relation(textAuthor(0, comment.ReplyTo), uid) == relationBlock) {
+		http.Error(w, "You are blocked by author", 403)
+		return
+	}
+
+	filtered := filterContent(user, content{Kind: "comment", ID: comment.CommentID, Text: comment.Comment})
+	if filtered.Outcome == filterReject {
+		w.WriteHeader(400)
+		returnJSON(filtered, w)
+		return
+	}
+	wasHeld := comment.CommentID != 0 && !editAny && isInDB("SELECT commentId FROM comments WHERE status = 4 AND commentId = ?", comment.CommentID)
+	held := filtered.Outcome == filterHold || wasHeld
+
+	html := renderMarkdown(comment.Comment)
+
+	// Write comment and its new revision together
+	id := comment.CommentID
+	e := execTx(func(tx *sql.Tx) error {
+		if id == 0 {
+			ins := `INSERT INTO comments(postId, comment, html, userId, parentId) VALUES (
+				(SELECT postId FROM posts WHERE postId = $1 AND status IN (1, 2)), $2, $3, $4,
+				COALESCE((SELECT commentId FROM comments WHERE commentId = $5 AND postId = $1), 0))`
+			res, insError := tx.Exec(ins, comment.PostID, comment.Comment, html, uid, comment.ReplyTo)
+			if insError != nil {
+				return insError
+			}
+			id, insError = res.LastInsertId()
+			if insError != nil {
+				return insError
+			}
+		} else {
+			upd := `UPDATE comments SET comment = $1, html = $2 WHERE commentId= $3 AND status != 0 AND (userId = $4 OR $5)`
+			res, updError := tx.Exec(upd, comment.Comment, html, comment.CommentID, uid, editAny)
+			if updError != nil {
+				return updError
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return sql.ErrNoRows
+			}
+		}
+		if filtered.Outcome == filterHold {
+			upd := `UPDATE comments SET status = $1, heldReason = $2 WHERE commentId = $3`
+			if _, heldError := tx.Exec(upd, statusHeld, filtered.Reason, id); heldError != nil {
+				return heldError
+			}
+		}
+		return commentRevision(tx, id, uid, comment.Reason)
+	})
+
+	// No such comment (or it is in trash) or user is not allowed to edit it
+	if e == sql.ErrNoRows {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	err(e)
+	if moderated {
+		audit(r, "comment.edit", "comment", id, before, commentSnapshot(id))
+	}
 
+	if held {
+		if filtered.Outcome != filterHold {
+			filtered = verdict{filterHold, "waiting for review"}
+		}
+		w.WriteHeader(http.StatusAccepted)
+		returnJSON(filtered, w)
+		return
+	}
+	saveMentions(0, id, uid, comment.Comment)
 	if comment.CommentID == 0 {
-		ins := `INSERT INTO comments(postId, comment, userId) VALUES ((SELECT postId FROM posts WHERE postId = $1), $2, $3)`
-		err(insert(ins, false, comment.PostID, newComment, uid))
+		liveComment("comment.new", id)
+		notifyReply(id)
 	} else {
-		upd := `UPDATE comments SET comment = $1 WHERE commentId= $2 AND (userId = $3 OR $4 = 'admin' OR $4 = 'moderator')`
-		err(insert(upd, false, newComment, comment.CommentID, uid, role))
+		liveComment("comment.update", id)
 	}
 }
 
@@ -353,7 +601,7 @@ func reaction(w http.ResponseWriter, r *http.Request) {
 	reactionValid := react.Reaction == "like" || react.Reaction == "dislike" || react.Reaction == "idle"
 	if react.PostID > 0 && react.CommentID == 0 && reactionValid {
 		id = react.PostID
-		query = `INSERT INTO postReactions(reaction, postId, userId) VALUES ($1, (SELECT postId FROM posts WHERE postId = $2), $3)`
+		query = `INSERT INTO postReactions(reaction, postId, userId) VALUES ($1, (SELECT postId FROM posts WHERE postId = $2 AND status IN (1, 2)), $3)`
 		upd = `UPDATE postReactions SET reaction = (CASE WHEN reaction = $1 THEN 'idle' ELSE $1 END) WHERE postId = $2 AND userId = $3`
 
 	} else if react.PostID == 0 && react.CommentID > 0 && reactionValid {
@@ -365,16 +613,25 @@ func reaction(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(400), 400)
 		return
 	}
+	if isLocked(react.PostID, react.CommentID) {
+		http.Error(w, "Post is locked", http.StatusLocked)
+		return
+	}
+
 	uid := ctx("user", r).(ctxData).ID
 	rollback := insert(query, false, react.Reaction, id, uid)
 	if rollback != nil {
 		err(insert(upd, false, react.Reaction, id, uid))
 	}
+	liveReaction(react.PostID, react.CommentID)
+	if react.Reaction == "like" {
+		notifyMilestones(react.PostID, react.CommentID, uid)
+	}
 
 }
 
 func updcategory(w http.ResponseWriter, r *http.Request) {
-	if ctx("user", r).(ctxData).Role != "admin" {
+	if !can(ctx("user", r).(ctxData), permCategoryManage) {
 		http.Error(w, http.StatusText(403), 403)
 		return
 	}
@@ -387,19 +644,29 @@ func updcategory(w http.ResponseWriter, r *http.Request) {
 	var validity report
 	validity.regcheck("wrong category name", cat.Name, `^.{2,10}$`)
 	validity.regcheck("wrong description", cat.Description, `^.{2,}$`)
-	if ctx("user", r).(ctxData).Role == "admin" && len(validity) == 0 {
+	if len(validity) == 0 {
 		if cat.CategoryID == 0 {
 			query := "INSERT INTO categories(name, description) VALUES ($1, $2)"
-			err(insert(query, false, cat.Name, cat.Description))
+			err(execTx(func(tx *sql.Tx) error {
+				res, insError := tx.Exec(query, cat.Name, cat.Description)
+				if insError != nil {
+					return insError
+				}
+				cat.CategoryID, insError = res.LastInsertId()
+				return insError
+			}))
+			audit(r, "category.create", "category", cat.CategoryID, nil, categorySnapshot(cat.CategoryID))
 		} else {
+			before := categorySnapshot(cat.CategoryID)
 			query := "UPDATE categories SET name = $1, description = $2 WHERE categoryId = $3"
 			err(insert(query, false, cat.Name, cat.Description, cat.CategoryID))
+			audit(r, "category.update", "category", cat.CategoryID, before, categorySnapshot(cat.CategoryID))
 		}
 	}
 }
 
 func deletecategory(w http.ResponseWriter, r *http.Request) {
-	if ctx("user", r).(ctxData).Role != "admin" {
+	if !can(ctx("user", r).(ctxData), permCategoryManage) {
 		http.Error(w, http.StatusText(403), 403)
 		return
 	}
@@ -407,11 +674,26 @@ func deletecategory(w http.ResponseWriter, r *http.Request) {
 		CategoryID int64 `json:"categoryID"`
 	}
 	readBody(r, &cat)
-	category := "%\"" + strconv.FormatInt(cat.CategoryID, 10) + "\"%"
-	query := `
-		DELETE FROM categories WHERE categoryId = $1;
-		UPDATE posts SET categories = REPLACE(categories, $2, '') WHERE categories LIKE $2;`
-	err(insert(query, false, cat.CategoryID, category))
+	before := categorySnapshot(cat.CategoryID)
+	category := "\"" + strconv.FormatInt(cat.CategoryID, 10) + "\""
+	err(execTx(func(tx *sql.Tx) error {
+		queries := []string{
+			`DELETE FROM categories WHERE categoryId = $1`,
+			`DELETE FROM categoryModerators WHERE categoryId = $1`,
+			`DELETE FROM categorySubscriptions WHERE categoryId = $1`,
+		}
+		for _, query := range queries {
+			if _, execError := tx.Exec(query, cat.CategoryID); execError != nil {
+				return execError
+			}
+		}
+		query := `UPDATE posts SET categories = REPLACE(categories, $1, '') WHERE categories LIKE '%' || $1 || '%'`
+		_, execError := tx.Exec(query, category)
+		return execError
+	}))
+	if before != nil {
+		audit(r, "category.delete", "category", cat.CategoryID, before, nil)
+	}
 }
 
 func categories(w http.ResponseWriter, r *http.Request) {
@@ -426,24 +708,27 @@ func categories(w http.ResponseWriter, r *http.Request) {
 }
 
 func users(w http.ResponseWriter, r *http.Request) {
-	if ctx("user", r).(ctxData).Role != "admin" {
+	if !can(ctx("user", r).(ctxData), permUserList) {
 		http.Error(w, http.StatusText(403), 403)
 		return
 	}
 	var users []struct {
-		Fullname string
-		Username string
-		Email    string
-		Role     string
-		Status   int64
-	}
-	query := `SELECT fullname, username, email, role, status FROM users`
-	sliceFromDB(&users, query, nil)
+		UserID      int64
+		Fullname    string
+		Username    string
+		Email       string
+		Role        string
+		Status      int64
+		Suspensions []interface{}
+	}
+	query := `SELECT userId, fullname, username, email, role, status, CAST(userId AS TEXT) FROM users`
+	sliceFromDB(&users, query, suspensionHistory)
 	returnJSON(users, w)
 }
 
+// Give user one of existing roles, see /api/roles
 func changerole(w http.ResponseWriter, r *http.Request) {
-	if ctx("user", r).(ctxData).Role != "admin" {
+	if !can(ctx("user", r).(ctxData), permRoleManage) {
 		http.Error(w, http.StatusText(403), 403)
 		return
 	}
@@ -452,20 +737,39 @@ func changerole(w http.ResponseWriter, r *http.Request) {
 		Role   string `json:"role"`
 	}
 	readBody(r, &user)
+	if !roleExists(user.Role) {
+		http.Error(w, "No such role", 400)
+		return
+	}
+	before := userSnapshot(user.UserID)
 	query := `UPDATE users SET role = $1 WHERE userId = $2`
 	err(insert(query, false, user.Role, user.UserID))
+	audit(r, "user.role", "user", user.UserID, before, userSnapshot(user.UserID))
+
+	// Role is kept in JWT, so user logs in again to get the new one
+	endSession(user.UserID)
+	notify(user.UserID, notifyRole, ctx("user", r).(ctxData).ID, 0, 0, user.Role)
 }
 
+// Report post or comment, reports on the same text are grouped into one
+// moderation case while it is active, user can report it only once per case
 func claim(w http.ResponseWriter, r *http.Request) {
 	var claim struct {
 		PostID    int64  `json:"postID"`
 		CommentID int64  `json:"commentID"`
 		Text      string `json:"text"`
+		Reason    string `json:"reason"`
 	}
 	readBody(r, &claim)
+	if claim.Reason == "" {
+		claim.Reason = "other"
+	}
 
 	var validity report
 	validity.regcheck("no claim text", strings.TrimSpace(claim.Text), `^.{2,}$`)
+	if !validReason(claim.Reason) {
+		validity = append(validity, "bad reason")
+	}
 
 	if len(validity) > 0 {
 		w.WriteHeader(400)
@@ -473,30 +777,88 @@ func claim(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var query string
+	// Claims are reviewed by moderators anyway, so only rejection matters
+	user := ctx("user", r).(ctxData)
+	if filtered := filterContent(user, content{Kind: "claim", Text: claim.Text}); filtered.Outcome == filterReject {
+		w.WriteHeader(400)
+		returnJSON(filtered, w)
+		return
+	}
+
+	var typ, query string
 	var id int64
 	if claim.PostID > 0 && claim.CommentID == 0 {
-		id = claim.PostID
-		query = `INSERT INTO claims(type, textId, claim, userId) VALUES('post', $1, $2, $3)`
+		typ, id = "post", claim.PostID
+		query = `SELECT postId FROM posts WHERE status IN (1, 2) AND postId = ?`
 	} else if claim.PostID == 0 && claim.CommentID > 0 {
-		id = claim.CommentID
-		query = `INSERT INTO claims(type, textId, claim, userId) VALUES('comment', $1, $2, $3)`
+		typ, id = "comment", claim.CommentID
+		query = `SELECT commentId FROM comments WHERE status IN (1, 2) AND commentId = ?`
 	} else {
 		http.Error(w, http.StatusText(400), 400)
 		return
 	}
-	uid := ctx("user", r).(ctxData).ID
-	err(insert(query, false, id, claim.Text, uid))
+	if !isInDB(query, id) {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	uid := user.ID
+	var reported []struct {
+		ClaimID int64
+	}
+	query = `SELECT claimId FROM claims WHERE caseId = $1 AND userId = $2`
+	sliceFromDB(&reported, query, nil, activeCase(typ, id), uid)
+	if len(reported) > 0 {
+		http.Error(w, "Already reported", http.StatusConflict)
+		return
+	}
+
+	// Reports of trusted users weigh more
+	weight := trustReportWeight[trustLevel(uid)]
+
+	// New case is opened unless text already has an active one
+	err(execTx(func(tx *sql.Tx) error {
+		ins := `INSERT INTO claimCases(type, textId) SELECT $1, $2
+			WHERE NOT EXISTS (SELECT caseId FROM claimCases WHERE type = $1 AND textId = $2 AND state IN ($3, $4))`
+		if _, execError := tx.Exec(ins, typ, id, caseOpen, caseReview); execError != nil {
+			return execError
+		}
+		ins = `INSERT INTO claims(type, textId, claim, userId, reason, caseId, weight) VALUES ($1, $2, $3, $4, $5,
+			(SELECT caseId FROM claimCases WHERE type = $1 AND textId = $2 AND state IN ($6, $7)), $8)`
+		_, execError := tx.Exec(ins, typ, id, claim.Text, uid, claim.Reason, caseOpen, caseReview, weight)
+		return execError
+	}))
+
+	// Moderators see new claim immediately
+	found, _ := getCase(activeCase(typ, id))
+	var opened struct {
+		CaseID  int64  `json:"caseID"`
+		Type    string `json:"type"`
+		TextID  int64  `json:"textID"`
+		Reason  string `json:"reason"`
+		Claim   string `json:"claim"`
+		Reports int64  `json:"reports"`
+	}
+	opened.CaseID, opened.Type, opened.TextID = found.CaseID, typ, id
+	opened.Reason, opened.Claim, opened.Reports = claim.Reason, claim.Text, found.Reports
+	publish("claim.new", opened, claimTopics(found.PostID)...)
 }
 
+// Unresolved reports one by one, moderation queue is /api/claimcases
 func viewclaims(w http.ResponseWriter, r *http.Request) {
-	var claims []struct {
+	user := ctx("user", r).(ctxData)
+	if !canSome(user, permClaimView) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	var claims, visible []struct {
 		ClaimID  int64
 		Claimed  int64
 		Type     string
 		TextID   int64
 		Username string
 		Claim    string
+		Reason   string
+		CaseID   int64
 	}
 
 	query := `SELECT 
@@ -505,20 +867,44 @@ func viewclaims(w http.ResponseWriter, r *http.Request) {
 				type, 
 				textId, 
 				(SELECT username FROM users WHERE userId = c.userId), 
-				claim 
+				claim,
+				reason,
+				caseId
 			FROM claims c WHERE status > '0'`
 	sliceFromDB(&claims, query, nil)
 
-	returnJSON(claims, w)
+	// Category moderators see only claims on their categories
+	for _, c := range claims {
+		if canClaim(user, permClaimView, c.Type, c.TextID) {
+			visible = append(visible, c)
+		}
+	}
+	returnJSON(visible, w)
 }
 
+// Resolves the whole case of claim as actioned, kept for older clients
 func doneclaim(w http.ResponseWriter, r *http.Request) {
+	moderator := ctx("user", r).(ctxData)
 	var claim struct {
 		ClaimID int64 `json:"claimID"`
 	}
 	readBody(r, &claim)
-	query := `UPDATE claims SET status = '0' WHERE claimId = $1`
-	err(insert(query, false, claim.ClaimID))
+
+	var claimed []struct {
+		CaseID int64
+	}
+	sliceFromDB(&claimed, `SELECT caseId FROM claims WHERE claimId = $1 AND status > 0`, nil, claim.ClaimID)
+	if len(claimed) == 0 {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	found, ok := getCase(claimed[0].CaseID)
+	if !ok || !canText(moderator, permClaimResolve, found.PostID, 0) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	resolveCase(found, moderator.ID, caseActioned, "", "")
+	audit(r, "claim.resolve", "claim", found.CaseID, found, caseSnapshot(found.CaseID))
 }
 
 func uploadava(w http.ResponseWriter, r *http.Request) {
@@ -533,6 +919,9 @@ func uploadava(w http.ResponseWriter, r *http.Request) {
 }
 
 func uploadimg(w http.ResponseWriter, r *http.Request) {
+	if !trusted(w, ctx("user", r).(ctxData).ID, trustUpload) {
+		return
+	}
 	filename := strconv.FormatInt(time.Now().Unix(), 10)
 	path, uploadError := uploadFile(r, "image", "/images", filename, "image/jpeg", "image/jpg", "image/gif", "image/png")
 	if uploadError != nil {
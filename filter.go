@@ -0,0 +1,341 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Outcomes of content filter, from the mildest
+const (
+	filterAllow  = "allow"
+	filterHold   = "hold"
+	filterReject = "reject"
+)
+
+// Text checked before it is saved, ID is 0 for new one
+type content struct {
+	UserID int64
+	Kind   string // "post", "comment" or "claim"
+	ID     int64
+	Title  string
+	Text   string
+}
+
+type verdict struct {
+	Outcome string `json:"filter"`
+	Reason  string `json:"reason"`
+}
+
+// Single check of content filter pipeline
+type contentFilter interface {
+	check(c content) verdict
+}
+
+// Filters run one by one, the strictest outcome wins
+var contentFilters = []contentFilter{
+	blocklistFilter{},
+	linkFilter{},
+	duplicateFilter{},
+	bayesFilter{},
+}
+
+func severity(outcome string) int {
+	switch outcome {
+	case filterReject:
+		return 2
+	case filterHold:
+		return 1
+	}
+	return 0
+}
+
+// Run content through the pipeline, texts of moderators are not filtered
+func filterContent(user ctxData, c content) verdict {
+	res := verdict{Outcome: filterAllow}
+	if can(user, permPostEditAny) {
+		return res
+	}
+	c.UserID = user.ID
+	for _, f := range contentFilters {
+		v := f.check(c)
+		if severity(v.Outcome) > severity(res.Outcome) {
+			res = v
+		}
+		if res.Outcome == filterReject {
+			break
+		}
+	}
+	return res
+}
+
+// Words or regular expressions from blocklist managed by admins
+type blocklistFilter struct{}
+
+func (blocklistFilter) check(c content) verdict {
+	var patterns []struct {
+		Pattern string
+		Regex   int64
+		Outcome string
+	}
+	sliceFromDB(&patterns, `SELECT pattern, regex, outcome FROM blocklist`, nil)
+	text := strings.ToLower(c.Title + "\n" + c.Text)
+	res := verdict{Outcome: filterAllow}
+	for _, p := range patterns {
+		matched := false
+		if p.Regex == 1 {
+			re, compileError := regexp.Compile("(?i)" + p.Pattern)
+			matched = compileError == nil && re.MatchString(text)
+		} else {
+			matched = strings.Contains(text, strings.ToLower(p.Pattern))
+		}
+		if matched && severity(p.Outcome) > severity(res.Outcome) {
+			res = verdict{p.Outcome, "blocklist: " + p.Pattern}
+		}
+	}
+	return res
+}
+
+var linkPattern = regexp.MustCompile(`(?i)(https?://|www\.)`)
+
+// Users with low trust level can't post many links at once
+type linkFilter struct{}
+
+func (linkFilter) check(c content) verdict {
+	if len(linkPattern.FindAllString(c.Text, -1)) <= newAccountLinks {
+		return verdict{Outcome: filterAllow}
+	}
+	if trustLevel(c.UserID) < trustLinks {
+		return verdict{filterHold, "too many links for trust level"}
+	}
+	return verdict{Outcome: filterAllow}
+}
+
+// Same text posted by user again and again. Short texts and claims
+// (same reason for different posts is fine) are not checked
+type duplicateFilter struct{}
+
+func normalizeText(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+func (duplicateFilter) check(c content) verdict {
+	text := normalizeText(c.Text)
+	if c.Kind == "claim" || len(text) < duplicateMinLength {
+		return verdict{Outcome: filterAllow}
+	}
+	postID, commentID := int64(0), int64(0)
+	if c.Kind == "post" {
+		postID = c.ID
+	} else {
+		commentID = c.ID
+	}
+	var recent []struct {
+		Text string
+	}
+	query := `
+	SELECT text FROM posts WHERE userId = $1 AND posted > datetime($2, 'unixepoch') AND postId != $3 AND status != 0
+	UNION ALL
+	SELECT comment FROM comments WHERE userId = $1 AND commented > datetime($2, 'unixepoch') AND commentId != $4 AND status != 0`
+	sliceFromDB(&recent, query, nil, c.UserID, time.Now().Add(-duplicateWindow).Unix(), postID, commentID)
+	for _, r := range recent {
+		if normalizeText(r.Text) == text {
+			return verdict{filterReject, "duplicate content"}
+		}
+	}
+	return verdict{Outcome: filterAllow}
+}
+
+// Spam classifier trained on moderator decisions
+type bayesFilter struct{}
+
+func (bayesFilter) check(c content) verdict {
+	p, trained := spamProbability(c.Title + "\n" + c.Text)
+	switch {
+	case !trained:
+		return verdict{Outcome: filterAllow}
+	case p >= bayesReject:
+		return verdict{filterReject, "spam classifier"}
+	case p >= bayesHold:
+		return verdict{filterHold, "spam classifier"}
+	}
+	return verdict{Outcome: filterAllow}
+}
+
+// GET lists blocklist, POST {"pattern", "regex", "outcome"} adds pattern
+func blocklist(w http.ResponseWriter, r *http.Request) {
+	if !can(ctx("user", r).(ctxData), permFilterManage) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	if r.Method == http.MethodPost {
+		var req struct {
+			Pattern string `json:"pattern"`
+			Regex   bool   `json:"regex"`
+			Outcome string `json:"outcome"`
+		}
+		readBody(r, &req)
+		if req.Outcome == "" {
+			req.Outcome = filterReject
+		}
+		_, compileError := regexp.Compile(req.Pattern)
+		if strings.TrimSpace(req.Pattern) == "" || (req.Regex && compileError != nil) ||
+			(req.Outcome != filterHold && req.Outcome != filterReject) {
+			http.Error(w, http.StatusText(400), 400)
+			return
+		}
+		err(insert(`INSERT INTO blocklist(pattern, regex, outcome) VALUES ($1, $2, $3)`, false, req.Pattern, req.Regex, req.Outcome))
+		audit(r, "filter.block", "blocklist", 0, nil, req)
+	}
+
+	var list []struct {
+		BlockID int64  `json:"id"`
+		Created int64  `json:"created"`
+		Pattern string `json:"pattern"`
+		Regex   int64  `json:"regex"`
+		Outcome string `json:"outcome"`
+	}
+	query := `SELECT blockId, CAST(strftime('%s', created) AS INT), pattern, regex, outcome FROM blocklist ORDER BY blockId`
+	sliceFromDB(&list, query, nil)
+	returnJSON(list, w)
+}
+
+// Remove pattern {"id"} from blocklist
+func unblock(w http.ResponseWriter, r *http.Request) {
+	if !can(ctx("user", r).(ctxData), permFilterManage) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	var req struct {
+		BlockID int64 `json:"id"`
+	}
+	readBody(r, &req)
+	var before []struct {
+		Pattern string `json:"pattern"`
+		Outcome string `json:"outcome"`
+	}
+	sliceFromDB(&before, `SELECT pattern, outcome FROM blocklist WHERE blockId = $1`, nil, req.BlockID)
+	if len(before) == 0 {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	err(insert(`DELETE FROM blocklist WHERE blockId = $1`, false, req.BlockID))
+	audit(r, "filter.unblock", "blocklist", req.BlockID, before[0], nil)
+}
+
+type heldItem struct {
+	Type      string `json:"type"`
+	PostID    int64  `json:"postID"`
+	CommentID int64  `json:"commentID"`
+	Title     string `json:"title"`
+	Text      string `json:"text"`
+	AuthorID  int64  `json:"authorID"`
+	Author    string `json:"author"`
+	Reason    string `json:"reason"`
+}
+
+// Posts and comments held by content filter
+func held(w http.ResponseWriter, r *http.Request) {
+	user := ctx("user", r).(ctxData)
+	if !canSome(user, permPostEditAny) && !canSome(user, permCommentEditAny) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	var items []heldItem
+	query := `
+	SELECT 'post', p.postId, 0, p.title, p.text, p.userId,
+		COALESCE((SELECT username FROM users u WHERE u.userId = p.userId), ''), p.heldReason
+	FROM posts p WHERE p.status = $1
+	UNION ALL
+	SELECT 'comment', c.postId, c.commentId, COALESCE((SELECT title FROM posts p WHERE p.postId = c.postId), ''), c.comment, c.userId,
+		COALESCE((SELECT username FROM users u WHERE u.userId = c.userId), ''), c.heldReason
+	FROM comments c WHERE c.status = $1`
+	sliceFromDB(&items, query, nil, statusHeld)
+
+	visible := []heldItem{}
+	for _, item := range items {
+		perm := permPostEditAny
+		if item.Type == "comment" {
+			perm = permCommentEditAny
+		}
+		if canText(user, perm, item.PostID, 0) {
+			visible = append(visible, item)
+		}
+	}
+	returnJSON(visible, w)
+}
+
+// Approve held post or comment (it is published) or reject it (goes to trash)
+// Decision trains spam classifier
+func reviewheld(w http.ResponseWriter, r *http.Request) {
+	user := ctx("user", r).(ctxData)
+	var req struct {
+		PostID    int64 `json:"postID"`
+		CommentID int64 `json:"commentID"`
+		Approve   bool  `json:"approve"`
+	}
+	readBody(r, &req)
+
+	var text []struct {
+		UserID int64
+		Text   string
+	}
+	if req.PostID > 0 && req.CommentID == 0 {
+		if !canText(user, permPostEditAny, req.PostID, 0) {
+			http.Error(w, http.StatusText(403), 403)
+			return
+		}
+		sliceFromDB(&text, `SELECT userId, title || char(10) || text FROM posts WHERE postId = $1 AND status = $2`, nil, req.PostID, statusHeld)
+	} else if req.PostID == 0 && req.CommentID > 0 {
+		if !canText(user, permCommentEditAny, 0, req.CommentID) {
+			http.Error(w, http.StatusText(403), 403)
+			return
+		}
+		sliceFromDB(&text, `SELECT userId, comment FROM comments WHERE commentId = $1 AND status = $2`, nil, req.CommentID, statusHeld)
+	} else {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	if len(text) == 0 {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	trainSpam(text[0].Text, !req.Approve)
+
+	if !req.Approve {
+		if req.CommentID > 0 {
+			before := commentSnapshot(req.CommentID)
+			trashComment(req.CommentID, user.ID)
+			audit(r, "comment.reject", "comment", req.CommentID, before, commentSnapshot(req.CommentID))
+		} else {
+			before := postSnapshot(req.PostID)
+			trashPost(req.PostID, user.ID)
+			audit(r, "post.reject", "post", req.PostID, before, postSnapshot(req.PostID))
+		}
+		return
+	}
+
+	// Approved text is published as if it was never held
+	if req.CommentID > 0 {
+		before := commentSnapshot(req.CommentID)
+		err(insert(`UPDATE comments SET status = 1, heldReason = '' WHERE commentId = $1`, false, req.CommentID))
+		audit(r, "comment.approve", "comment", req.CommentID, before, commentSnapshot(req.CommentID))
+		saveMentions(0, req.CommentID, text[0].UserID, text[0].Text)
+		liveComment("comment.new", req.CommentID)
+		notifyReply(req.CommentID)
+		return
+	}
+	var post []struct {
+		Text string
+	}
+	sliceFromDB(&post, `SELECT text FROM posts WHERE postId = $1`, nil, req.PostID)
+	before := postSnapshot(req.PostID)
+	query := `UPDATE posts SET status = CASE WHEN publishAt > CURRENT_TIMESTAMP THEN $1 ELSE 1 END, heldReason = '' WHERE postId = $2`
+	err(insert(query, false, statusDraft, req.PostID))
+	audit(r, "post.approve", "post", req.PostID, before, postSnapshot(req.PostID))
+	if !isInDB(`SELECT postId FROM posts WHERE status = 3 AND postId = ?`, req.PostID) {
+		saveMentions(req.PostID, 0, text[0].UserID, post[0].Text)
+		livePost("post.new", req.PostID)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Followed posts and users are kept in follows, followed categories are
+// subscriptions also used for email digest
+const (
+	followPost     = "post"
+	followCategory = "category"
+	followUser     = "user"
+)
+
+// Posts p in feed of user $1: followed ones, posts of followed users and in followed categories
+const feedCondition = `
+	p.status IN (1, 2)
+	AND (p.postId IN (SELECT targetId FROM follows WHERE userId = $1 AND type = 'post')
+		OR p.userId IN (SELECT targetId FROM follows WHERE userId = $1 AND type = 'user')
+		OR EXISTS (SELECT categoryId FROM categorySubscriptions s WHERE s.userId = $1 AND p.categories LIKE '%"' || s.categoryId || '"%'))`
+
+// Follow or unfollow {"type": "post" | "category" | "user", "id", "follow"}
+func follow(w http.ResponseWriter, r *http.Request) {
+	uid := ctx("user", r).(ctxData).ID
+	var req struct {
+		Type   string `json:"type"`
+		ID     int64  `json:"id"`
+		Follow bool   `json:"follow"`
+	}
+	readBody(r, &req)
+
+	exists := false
+	switch req.Type {
+	case followPost:
+		exists = isInDB(`SELECT postId FROM posts WHERE status IN (1, 2) AND postId = ?`, req.ID)
+	case followUser:
+		exists = req.ID != uid && isInDB(`SELECT userId FROM users WHERE userId = ?`, req.ID)
+	case followCategory:
+		_, catsError := processCategories([]int64{req.ID})
+		exists = catsError == nil
+	default:
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	if req.Follow && !exists {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	var query string
+	switch {
+	case req.Type == followCategory && req.Follow:
+		query = `INSERT OR IGNORE INTO categorySubscriptions(userId, categoryId) VALUES ($1, $2)`
+	case req.Type == followCategory:
+		query = `DELETE FROM categorySubscriptions WHERE userId = $1 AND categoryId = $2`
+	case req.Follow:
+		query = `INSERT OR IGNORE INTO follows(userId, targetId, type) VALUES ($1, $2, $3)`
+	default:
+		query = `DELETE FROM follows WHERE userId = $1 AND targetId = $2 AND type = $3`
+	}
+	if req.Type == followCategory {
+		err(insert(query, false, uid, req.ID))
+	} else {
+		err(insert(query, false, uid, req.ID, req.Type))
+	}
+}
+
+// Everything current user follows
+func follows(w http.ResponseWriter, r *http.Request) {
+	type followed struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	}
+	var res struct {
+		Posts      []followed `json:"posts"`
+		Categories []followed `json:"categories"`
+		Users      []followed `json:"users"`
+	}
+	uid := ctx("user", r).(ctxData).ID
+	res.Posts, res.Categories, res.Users = []followed{}, []followed{}, []followed{}
+	query := `SELECT f.targetId, p.title FROM follows f JOIN posts p ON p.postId = f.targetId
+		WHERE f.userId = $1 AND f.type = 'post' AND p.status IN (1, 2) ORDER BY f.created DESC`
+	sliceFromDB(&res.Posts, query, nil, uid)
+	query = `SELECT c.categoryId, c.name FROM categorySubscriptions s JOIN categories c ON c.categoryId = s.categoryId
+		WHERE s.userId = $1 ORDER BY c.name`
+	sliceFromDB(&res.Categories, query, nil, uid)
+	query = `SELECT f.targetId, u.username FROM follows f JOIN users u ON u.userId = f.targetId
+		WHERE f.userId = $1 AND f.type = 'user' ORDER BY u.username`
+	sliceFromDB(&res.Users, query, nil, uid)
+	returnJSON(res, w)
+}
+
+type feedPost struct {
+	PostID      int64         `json:"pid"`
+	Posted      int64         `json:"created"`
+	AuthorID    int64         `json:"uid"`
+	Username    string        `json:"username"`
+	Title       string        `json:"title"`
+	Likes       int64         `json:"likes"`
+	Dislikes    int64         `json:"dislikes"`
+	Comments    int64         `json:"comments"`
+	Activity    int64         `json:"activity"` // time of last comment or of post itself
+	Unread      int64         `json:"unread"`
+	NewComments int64         `json:"newComments"`
+	Followed    string        `json:"followed"` // why post is in feed: "post", "user" or "category"
+	Categories  []interface{} `json:"categories"`
+	Score       float64       `json:"score"`
+}
+
+// Ranking score: reactions and comments, decaying with age like on news sites
+func (p feedPost) rank(now time.Time) float64 {
+	hours := now.Sub(time.Unix(p.Posted, 0)).Hours()
+	if hours < 0 {
+		hours = 0
+	}
+	return float64(p.Likes-p.Dislikes+2*p.Comments+1) / math.Pow(hours+2, feedGravity)
+}
+
+// Personal feed of current user, ?order= is "recent" (by last activity, default)
+// or "top" (by ranking score). Post is unread if it has new activity since
+// user has seen it, unread comments of others are counted
+func feed(w http.ResponseWriter, r *http.Request) {
+	order := r.FormValue("order")
+	if order == "" {
+		order = "recent"
+	}
+	if order != "recent" && order != "top" {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	pageSize := 50
+	page, atoiError := strconv.Atoi(r.FormValue("page"))
+	if atoiError != nil || page <= 0 {
+		page = 1
+	}
+
+	var posts []feedPost
+	query := `
+	SELECT * FROM (
+		SELECT
+			p.postId,
+			CAST(strftime('%s', p.posted) AS INT),
+			p.userId,
+			COALESCE((SELECT username FROM users u WHERE u.userId = p.userId), ''),
+			p.title,
+			(SELECT COUNT(*) FROM postReactions r WHERE r.postId = p.postId AND reaction = 'like'),
+			(SELECT COUNT(*) FROM postReactions r WHERE r.postId = p.postId AND reaction = 'dislike'),
+			(SELECT COUNT(*) FROM comments c WHERE c.postId = p.postId AND c.status IN (1, 2)),
+			CAST(strftime('%s', MAX(p.posted, COALESCE((SELECT MAX(commented) FROM comments c WHERE c.postId = p.postId AND c.status IN (1, 2)), p.posted))) AS INT) AS activity,
+			CASE WHEN v.seen IS NULL OR v.seen < MAX(p.posted, COALESCE((SELECT MAX(commented) FROM comments c WHERE c.postId = p.postId AND c.status IN (1, 2) AND c.userId != $1), p.posted)) THEN 1 ELSE 0 END,
+			(SELECT COUNT(*) FROM comments c WHERE c.postId = p.postId AND c.status IN (1, 2) AND c.userId != $1 AND (v.seen IS NULL OR c.commented > v.seen)),
+			CASE
+				WHEN p.postId IN (SELECT targetId FROM follows WHERE userId = $1 AND type = 'post') THEN 'post'
+				WHEN p.userId IN (SELECT targetId FROM follows WHERE userId = $1 AND type = 'user') THEN 'user'
+				ELSE 'category' END,
+			p.categories,
+			0.0
+		FROM posts p LEFT JOIN postReads v ON v.postId = p.postId AND v.userId = $1
+		WHERE ` + feedCondition + ` AND ` + notMutedBy("p.userId") + `
+	) ORDER BY activity DESC LIMIT $2`
+	sliceFromDB(&posts, query, getCats, ctx("user", r).(ctxData).ID, feedCandidates)
+
+	now := time.Now()
+	for i := range posts {
+		posts[i].Score = posts[i].rank(now)
+	}
+	if order == "top" {
+		sort.SliceStable(posts, func(i, j int) bool { return posts[i].Score > posts[j].Score })
+	}
+
+	offset := page*pageSize - pageSize
+	if offset > len(posts) {
+		offset = len(posts)
+	}
+	end := offset + pageSize
+	if end > len(posts) {
+		end = len(posts)
+	}
+	returnJSON(append([]feedPost{}, posts[offset:end]...), w)
+}
+
+// Post is seen by user now, its activity till now is read
+func markSeen(userID, postID int64) {
+	query := `INSERT INTO postReads(userId, postId) VALUES ($1, $2)
+		ON CONFLICT(userId, postId) DO UPDATE SET seen = CURRENT_TIMESTAMP`
+	err(insert(query, false, userID, postID))
+}
+
+// Mark posts of feed {"postIDs"} (or all of them) as read
+func readfeed(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PostIDs []int64 `json:"postIDs"`
+		All     bool    `json:"all"`
+	}
+	readBody(r, &req)
+	uid := ctx("user", r).(ctxData).ID
+	if req.All {
+		var posts []struct {
+			ID int64
+		}
+		sliceFromDB(&posts, `SELECT p.postId FROM posts p WHERE `+feedCondition, nil, uid)
+		req.PostIDs = nil
+		for _, p := range posts {
+			req.PostIDs = append(req.PostIDs, p.ID)
+		}
+	}
+	for _, id := range req.PostIDs {
+		markSeen(uid, id)
+	}
+}
+
+// Notify followers of post about new comment, authors of post and of
+// replied comment are notified by notifyReply already
+func notifyFollowers(commentID int64) {
+	var followers []struct {
+		UserID  int64
+		ActorID int64
+		PostID  int64
+		Title   string
+	}
+	query := `
+	SELECT f.userId, c.userId, c.postId, p.title
+	FROM comments c
+	JOIN posts p ON p.postId = c.postId
+	JOIN follows f ON f.type = 'post' AND f.targetId = c.postId
+	WHERE c.commentId = $1 AND f.userId != p.userId
+		AND f.userId != COALESCE((SELECT userId FROM comments pc WHERE pc.commentId = c.parentId), 0)`
+	sliceFromDB(&followers, query, nil, commentID)
+	for _, f := range followers {
+		notify(f.UserID, notifyFollowed, f.ActorID, f.PostID, commentID, f.Title)
+	}
+}
@@ -3,6 +3,10 @@ module forum
 go 1.16
 
 require (
+	github.com/alecthomas/chroma v0.10.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/mattn/go-sqlite3 v1.14.8
-	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	github.com/microcosm-cc/bluemonday v1.0.27
+	github.com/yuin/goldmark v1.4.13
+	golang.org/x/crypto v0.24.0
 )
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"log"
 	"mime"
 	"os"
 	"path/filepath"
@@ -172,3 +173,19 @@ func uploadFile(r *http.Request, formname, path, filename string, formats ...str
 func regcheck(s, regex string) bool {
 	return !regexp.MustCompile(regex).MatchString(s)
 }
+
+// Run job in background with given interval, panic in one run is logged and does not stop next ones
+func every(interval time.Duration, job func()) {
+	go func() {
+		for range time.Tick(interval) {
+			func() {
+				defer func() {
+					if e := recover(); e != nil {
+						log.Printf("Background Job Error: %+v", e)
+					}
+				}()
+				job()
+			}()
+		}
+	}()
+}
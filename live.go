@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/websocket"
+)
+
+// Live event is delivered to every client subscribed to any of its topics:
+// "feed" (all posts), "category:ID", "post:ID", private "user:ID" and
+// "claims" or "claims:category:ID" of moderators
+type event struct {
+	ID     int64       `json:"id"`
+	Type   string      `json:"type"`
+	Topics []string    `json:"topics"`
+	Data   interface{} `json:"data"`
+}
+
+type liveClient struct {
+	userID int64
+	topics map[string]bool
+	send   chan event
+}
+
+// All connected clients and log of recent events for reconnecting ones
+// Event IDs start from server start time, so IDs of previous run are never reused
+var hub = struct {
+	sync.Mutex
+	clients map[*liveClient]bool
+	lastID  int64
+	log     []event
+}{
+	clients: make(map[*liveClient]bool),
+	lastID:  time.Now().UnixNano() / int64(time.Millisecond),
+}
+
+// Register client with initial topics (invalid ones are skipped), private
+// user topic and moderators topic are subscribed here
+// If client resumes after lastID, events it missed are returned from log,
+// resync is true when log does not reach that far and client must reload data
+func joinLive(userID int64, role string, lastID int64, topics ...string) (c *liveClient, missed []event, resync bool) {
+	c = &liveClient{
+		userID: userID,
+		topics: map[string]bool{"feed": true},
+		send:   make(chan event, liveBuffer),
+	}
+	for _, t := range topics {
+		c.subscribe(strings.TrimSpace(t), true)
+	}
+	if userID > 0 {
+		c.topics["user:"+strconv.FormatInt(userID, 10)] = true
+	}
+	if userID > 0 && can(ctxData{userID, role}, permClaimView) {
+		c.topics["claims"] = true
+	} else if userID > 0 && canSome(ctxData{userID, role}, permClaimView) {
+		for id := range moderatedCategories(userID) {
+			c.topics["claims:category:"+strconv.FormatInt(id, 10)] = true
+		}
+	}
+
+	hub.Lock()
+	defer hub.Unlock()
+	if lastID > 0 {
+		resync = len(hub.log) == 0 || hub.log[0].ID > lastID+1
+		for _, e := range hub.log {
+			if e.ID > lastID && c.wants(e.Topics) {
+				missed = append(missed, e)
+			}
+		}
+	}
+	hub.clients[c] = true
+	return c, missed, resync
+}
+
+func (c *liveClient) leave() {
+	hub.Lock()
+	delete(hub.clients, c)
+	close(c.send)
+	hub.Unlock()
+}
+
+// Public topics only, private user topic is subscribed on connect
+func (c *liveClient) subscribe(topic string, on bool) bool {
+	parts := strings.Split(topic, ":")
+	valid := topic == "feed"
+	if len(parts) == 2 && (parts[0] == "category" || parts[0] == "post") {
+		_, parseError := strconv.ParseInt(parts[1], 10, 64)
+		valid = parseError == nil
+	}
+	if !valid {
+		return false
+	}
+	hub.Lock()
+	if on {
+		c.topics[topic] = true
+	} else {
+		delete(c.topics, topic)
+	}
+	hub.Unlock()
+	return true
+}
+
+// Send event to subscribers, client which can't keep up misses events
+func publish(typ string, data interface{}, topics ...string) {
+	hub.Lock()
+	defer hub.Unlock()
+	hub.lastID++
+	e := event{ID: hub.lastID, Type: typ, Topics: topics, Data: data}
+	hub.log = append(hub.log, e)
+	if len(hub.log) > liveLogSize {
+		hub.log = hub.log[len(hub.log)-liveLogSize:]
+	}
+	for c := range hub.clients {
+		if c.wants(topics) {
+			select {
+			case c.send <- e:
+			default:
+			}
+		}
+	}
+}
+
+// Called with hub locked
+func (c *liveClient) wants(topics []string) bool {
+	for _, t := range topics {
+		if c.topics[t] {
+			return true
+		}
+	}
+	return false
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || origin == "http://"+r.Host || origin == "https://"+r.Host || origin == "http://localhost:8081"
+	},
+}
+
+// WebSocket connection for live updates
+// Client message {"action": "subscribe" | "unsubscribe", "topic": "post:1"}
+func ws(w http.ResponseWriter, r *http.Request) {
+
+	// Headers set by middleware (like refreshed JWT cookie) go into handshake response
+	conn, upgradeError := upgrader.Upgrade(w, r, w.Header())
+	if upgradeError != nil {
+		return
+	}
+	user := ctx("user", r).(ctxData)
+	c, _, _ := joinLive(user.ID, user.Role, 0)
+	c.present()
+
+	// Writer stops when client leaves and its channel is closed
+	go func() {
+		ping := time.NewTicker(livePing)
+		defer ping.Stop()
+		defer conn.Close()
+		for {
+			select {
+			case e, ok := <-c.send:
+				if !ok {
+					return
+				}
+				if conn.WriteJSON(e) != nil {
+					return
+				}
+			case <-ping.C:
+				if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(livePing)) != nil {
+					return
+				}
+				c.present()
+			}
+		}
+	}()
+
+	// Reader
+	defer c.leave()
+	conn.SetReadLimit(1024)
+	for {
+		var msg struct {
+			Action string `json:"action"`
+			Topic  string `json:"topic"`
+		}
+		if conn.ReadJSON(&msg) != nil {
+			return
+		}
+		ok := false
+		switch msg.Action {
+		case "subscribe":
+			ok = c.subscribe(msg.Topic, true)
+			c.present()
+		case "unsubscribe":
+			ok = c.subscribe(msg.Topic, false)
+		}
+		if !ok {
+			select {
+			case c.send <- event{Type: "error", Data: "invalid subscription"}:
+			default:
+			}
+		}
+	}
+}
+
+// Topics of post: global feed, its categories and post itself
+func postTopics(postID int64, categories string) []string {
+	topics := []string{"feed", "post:" + strconv.FormatInt(postID, 10)}
+	for _, cat := range strings.FieldsFunc(categories, func(c rune) bool { return !unicode.IsNumber(c) }) {
+		topics = append(topics, "category:"+cat)
+	}
+	return topics
+}
+
+// Publish new, updated or deleted post, drafts are not published
+func livePost(typ string, postID int64) {
+	var post []struct {
+		PostID     int64  `json:"pid"`
+		AuthorID   int64  `json:"uid"`
+		Username   string `json:"username"`
+		Title      string `json:"title"`
+		Status     int64  `json:"status"`
+		Categories string `json:"-"`
+	}
+	query := `
+	SELECT
+		p.postId,
+		p.userId,
+		(SELECT username FROM users u WHERE u.userId = p.userId),
+		p.title,
+		p.status,
+		p.categories
+	FROM posts p WHERE p.postId = $1 AND p.status NOT IN (3, 4)`
+	sliceFromDB(&post, query, nil, postID)
+	if len(post) == 0 || (typ == "post.delete") != (post[0].Status == statusDeleted) {
+		return
+	}
+	publish(typ, post[0], postTopics(postID, post[0].Categories)...)
+}
+
+// Publish new, updated or deleted comment to subscribers of its post
+func liveComment(typ string, commentID int64) {
+	var comment []struct {
+		CommentID int64  `json:"cid"`
+		PostID    int64  `json:"pid"`
+		AuthorID  int64  `json:"uid"`
+		Username  string `json:"username"`
+		HTML      string `json:"html"`
+		Status    int64  `json:"status"`
+	}
+	query := `
+	SELECT
+		c.commentId,
+		c.postId,
+		c.userId,
+		(SELECT username FROM users u WHERE u.userId = c.userId),
+		c.html,
+		c.status
+	FROM comments c WHERE c.commentId = $1 AND c.status != 4`
+	sliceFromDB(&comment, query, nil, commentID)
+	if len(comment) == 0 || (typ == "comment.delete") != (comment[0].Status == statusDeleted) {
+		return
+	}
+	publish(typ, comment[0], "post:"+strconv.FormatInt(comment[0].PostID, 10))
+}
+
+// Publish fresh like and dislike counts of post or comment
+func liveReaction(postID, commentID int64) {
+	var counts []struct {
+		PostID     int64  `json:"pid"`
+		CommentID  int64  `json:"cid"`
+		Likes      int64  `json:"likes"`
+		Dislikes   int64  `json:"dislikes"`
+		Categories string `json:"-"`
+	}
+	if commentID > 0 {
+		query := `
+		SELECT
+			c.postId,
+			c.commentId,
+			(SELECT COUNT(*) FROM commentReactions r WHERE r.commentId = c.commentId AND reaction = 'like'),
+			(SELECT COUNT(*) FROM commentReactions r WHERE r.commentId = c.commentId AND reaction = 'dislike'),
+			''
+		FROM comments c WHERE c.commentId = $1`
+		sliceFromDB(&counts, query, nil, commentID)
+		if len(counts) > 0 {
+			publish("reaction", counts[0], "post:"+strconv.FormatInt(counts[0].PostID, 10))
+		}
+		return
+	}
+	query := `
+	SELECT
+		p.postId,
+		0,
+		(SELECT COUNT(*) FROM postReactions r WHERE r.postId = p.postId AND reaction = 'like'),
+		(SELECT COUNT(*) FROM postReactions r WHERE r.postId = p.postId AND reaction = 'dislike'),
+		p.categories
+	FROM posts p WHERE p.postId = $1`
+	sliceFromDB(&counts, query, nil, postID)
+	if len(counts) > 0 {
+		publish("reaction", counts[0], postTopics(postID, counts[0].Categories)...)
+	}
+}
+
+// Server-Sent Events fallback for clients which can't use WebSocket
+// Topics are given once as query (?topics=post:1,category:2), reconnecting
+// client gets events it missed after Last-Event-ID header (or lastEventId query)
+func stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	if lastID == 0 {
+		lastID, _ = strconv.ParseInt(r.FormValue("lastEventId"), 10, 64)
+	}
+	user := ctx("user", r).(ctxData)
+	c, missed, resync := joinLive(user.ID, user.Role, lastID, strings.Split(r.FormValue("topics"), ",")...)
+	defer c.leave()
+	c.present()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	send := func(e event) {
+		data, jsonError := json.Marshal(e)
+		err(jsonError)
+		if e.ID > 0 {
+			fmt.Fprintf(w, "id: %d\n", e.ID)
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+	}
+	if resync {
+		send(event{Type: "resync"})
+	}
+	for _, e := range missed {
+		send(e)
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(livePing)
+	defer ping.Stop()
+	for {
+		select {
+		case e := <-c.send:
+			send(e)
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+			c.present()
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+type mail struct {
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+	Unsubscribe string
+}
+
+// Delivers single email, error means it should be retried later
+type mailer interface {
+	send(m mail) error
+}
+
+// Mailer used by queue: SMTP server when SMTP_HOST is set,
+// otherwise emails are written to local outbox directory
+var postman mailer
+
+func newMailer() mailer {
+	if os.Getenv("SMTP_HOST") == "" {
+		return fileMailer{dir: mailOutbox}
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return smtpMailer{
+		addr:     os.Getenv("SMTP_HOST") + ":" + port,
+		host:     os.Getenv("SMTP_HOST"),
+		user:     os.Getenv("SMTP_USER"),
+		password: os.Getenv("SMTP_PASSWORD"),
+	}
+}
+
+// Sender address and public address of forum used in links
+func mailFrom() string {
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		return from
+	}
+	return "forum@localhost"
+}
+
+func siteURL() string {
+	if url := os.Getenv("SITE_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return "http://localhost:8080"
+}
+
+type smtpMailer struct {
+	addr, host, user, password string
+}
+
+func (s smtpMailer) send(m mail) error {
+	var auth smtp.Auth
+	if s.user != "" {
+		auth = smtp.PlainAuth("", s.user, s.password, s.host)
+	}
+	return smtp.SendMail(s.addr, auth, mailFrom(), []string{m.To}, m.message())
+}
+
+// Development mailer, every email is saved as .eml file
+type fileMailer struct {
+	dir string
+}
+
+func (f fileMailer) send(m mail) error {
+	if mkdirError := os.MkdirAll(f.dir, 0755); mkdirError != nil {
+		return mkdirError
+	}
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + regexp.MustCompile(`[^a-zA-Z0-9.@_-]`).ReplaceAllString(m.To, "_") + ".eml"
+	return ioutil.WriteFile(filepath.Join(f.dir, name), m.message(), 0644)
+}
+
+// MIME message with text and HTML alternatives
+func (m mail) message() []byte {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, alt := range []struct{ typ, content string }{{"text/plain", m.Text}, {"text/html", m.HTML}} {
+		part, partError := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {alt.typ + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		err(partError)
+		qp := quotedprintable.NewWriter(part)
+		_, writeError := qp.Write([]byte(alt.content))
+		err(writeError)
+		err(qp.Close())
+	}
+	err(parts.Close())
+
+	var msg bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, strings.NewReplacer("\r", "", "\n", "").Replace(value))
+	}
+	header("From", mailFrom())
+	header("To", m.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	if m.Unsubscribe != "" {
+		header("List-Unsubscribe", "<"+m.Unsubscribe+">")
+		header("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes()
+}
+
+// Put email into queue, it is delivered by sendMails
+func queueMail(m mail) {
+	query := `INSERT INTO mailQueue(recipient, subject, text, html, unsubscribe) VALUES ($1, $2, $3, $4, $5)`
+	err(insert(query, false, m.To, m.Subject, m.Text, m.HTML, m.Unsubscribe))
+}
+
+// Deliver queued emails, failed ones are retried with growing delay
+// until mailRetries attempts are made
+func sendMails() {
+	var queue []struct {
+		ID          int64
+		Attempts    int64
+		To          string
+		Subject     string
+		Text        string
+		HTML        string
+		Unsubscribe string
+	}
+	query := `
+	SELECT mailId, attempts, recipient, subject, text, html, unsubscribe FROM mailQueue
+	WHERE sent IS NULL AND attempts < $1 AND nextTry <= CURRENT_TIMESTAMP
+	ORDER BY mailId LIMIT 100`
+	sliceFromDB(&queue, query, nil, mailRetries)
+
+	for _, m := range queue {
+		sendError := postman.send(mail{m.To, m.Subject, m.Text, m.HTML, m.Unsubscribe})
+		if sendError == nil {
+			err(insert(`UPDATE mailQueue SET sent = CURRENT_TIMESTAMP, attempts = attempts + 1 WHERE mailId = $1`, false, m.ID))
+			continue
+		}
+		delay := int64(mailRetryDelay/time.Second) << m.Attempts
+		upd := `UPDATE mailQueue SET
+			attempts = attempts + 1,
+			nextTry = datetime('now', '+' || $1 || ' seconds'),
+			error = $2
+			WHERE mailId = $3`
+		err(insert(upd, false, delay, sendError.Error(), m.ID))
+	}
+}
+
+// Both HTML and text bodies are rendered from templates with the same name
+type mailData struct {
+	Username    string
+	Message     string
+	Title       string
+	Link        string
+	Categories  []digestCategory
+	Unsubscribe string
+}
+
+var mailHTML = htmltemplate.Must(htmltemplate.New("mail").Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html><body style="font-family: sans-serif; max-width: 600px; margin: auto">
+<p>Hi, {{.Username}}!</p>{{end}}
+
+{{define "footer"}}<hr>
+<p style="font-size: small; color: gray">
+You get this email because of your forum settings.
+<a href="{{.Unsubscribe}}">Unsubscribe</a>
+</p>
+</body></html>{{end}}
+
+{{define "notification"}}{{template "header" .}}
+<p>{{.Message}}</p>
+{{if .Title}}<p><a href="{{.Link}}">{{.Title}}</a></p>{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "verify"}}{{template "header" .}}
+<p>{{.Message}}</p>
+<p><a href="{{.Link}}">{{.Title}}</a></p>
+</body></html>{{end}}
+
+{{define "digest"}}{{template "header" .}}
+<p>{{.Message}}</p>
+{{range .Categories}}<h3>{{.Name}}</h3>
+<ul>{{range .Posts}}
+<li><a href="{{.Link}}">{{.Title}}</a> by {{.Username}} ({{.Likes}} likes, {{.Comments}} comments)</li>{{end}}
+</ul>{{end}}
+{{template "footer" .}}{{end}}
+`))
+
+var mailText = texttemplate.Must(texttemplate.New("mail").Parse(`
+{{define "footer"}}
+--
+You get this email because of your forum settings.
+Unsubscribe: {{.Unsubscribe}}
+{{end}}
+
+{{define "notification"}}Hi, {{.Username}}!
+
+{{.Message}}
+{{if .Title}}
+{{.Title}}
+{{.Link}}
+{{end}}{{template "footer" .}}{{end}}
+
+{{define "verify"}}Hi, {{.Username}}!
+
+{{.Message}}
+
+{{.Title}}: {{.Link}}
+{{end}}
+
+{{define "digest"}}Hi, {{.Username}}!
+
+{{.Message}}
+{{range .Categories}}
+{{.Name}}
+{{range .Posts}}
+* {{.Title}} by {{.Username}} ({{.Likes}} likes, {{.Comments}} comments)
+  {{.Link}}
+{{end}}{{end}}{{template "footer" .}}{{end}}
+`))
+
+func renderMail(name string, data mailData) (text, html string) {
+	var t, h bytes.Buffer
+	err(mailText.ExecuteTemplate(&t, name, data))
+	err(mailHTML.ExecuteTemplate(&h, name, data))
+	return strings.TrimSpace(t.String()), h.String()
+}
@@ -14,6 +14,25 @@ func main() {
 	// Create Database if not exist and execute pre-written initial query from "config.go"
 	createDB(initialQuery)
 
+	// Bring existing Database up to date with schema changes from "config.go"
+	migrate(migrations)
+	loadRoles()
+
+	// Render HTML for content written before markdown support
+	renderMissing()
+
+	// Send emails through SMTP server or into local outbox
+	postman = newMailer()
+
+	// Background jobs
+	every(schedulerInterval, publishScheduled)
+	every(schedulerInterval, prunePresence)
+	every(schedulerInterval, sendMails)
+	every(digestInterval, sendDigests)
+	every(schedulerInterval, deleteAccounts)
+	every(schedulerInterval, liftExpired)
+	every(schedulerInterval, purgeTrash)
+
 	// Get port from dedicated server environment, if running locally assign port to 8080
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -32,31 +51,127 @@ func main() {
 	endpoint("/api/posts", posts)
 	endpoint("/api/post", post)
 
+	// Following posts, categories and users, and personal feed made of them
+	endpoint("/api/follow", follow, "check JWT", "personal")
+	endpoint("/api/follows", follows, "check JWT")
+	endpoint("/api/feed", feed, "check JWT")
+	endpoint("/api/readfeed", readfeed, "check JWT", "personal")
+
 	// Write or update post
-	endpoint("/api/writepost", writepost, "check JWT")
+	endpoint("/api/writepost", writepost, "check JWT", "writes")
+
+	// Drafts of current user and their autosave
+	endpoint("/api/drafts", drafts, "check JWT")
+	endpoint("/api/autosave", autosave, "check JWT", "writes")
+
+	// Live updates of posts, comments and reactions
+	endpoint("/api/ws", ws, "check JWT")
+	endpoint("/api/stream", stream, "check JWT")
+
+	// Who's online and who's viewing a post
+	endpoint("/api/online", online)
+	endpoint("/api/viewers", viewers)
+	endpoint("/api/hidepresence", hidepresence, "check JWT", "personal")
+
+	// Settings of current user
+	endpoint("/api/me", me, "check JWT")
+	endpoint("/api/verifyemail", verifyemail)
+	endpoint("/api/export", export, "check JWT", "personal")
+	endpoint("/api/deleteaccount", deleteaccount, "check JWT", "personal")
+	endpoint("/api/canceldeletion", canceldeletion, "check JWT", "personal")
+
+	// Public profile of user and what of it is hidden
+	endpoint("/api/profile", profile)
+	endpoint("/api/privacy", privacy, "check JWT", "personal")
+
+	// Users muted or blocked by current user
+	endpoint("/api/blocks", blocklists, "check JWT", "personal")
+
+	// Private conversations and their messages
+	endpoint("/api/conversations", conversations, "check JWT")
+	endpoint("/api/messages", messages, "check JWT")
+	endpoint("/api/sendmessage", sendmessage, "check JWT", "writes")
+	endpoint("/api/readmessages", readmessages, "check JWT", "personal")
+	endpoint("/api/unreadmessages", unreadmessages, "check JWT")
+
+	// Notifications of current user and which types they want to get
+	endpoint("/api/notifications", notifications, "check JWT")
+	endpoint("/api/unreadcount", unreadcount, "check JWT")
+	endpoint("/api/readnotifications", readnotifications, "check JWT", "personal")
+	endpoint("/api/notifyprefs", notifyprefs, "check JWT", "personal")
+	endpoint("/api/emailprefs", emailprefs, "check JWT", "personal")
+	endpoint("/api/unsubscribe", unsubscribe)
+
+	// Moderator pins, locks or marks post as announcement
+	endpoint("/api/moderatepost", moderatepost, "check JWT")
 
 	// Get all comments by post ID
 	endpoint("/api/comments", comments)
 
 	// Wrie comment or update comment
-	endpoint("/api/writecomment", writecomment, "check JWT")
+	endpoint("/api/writecomment", writecomment, "check JWT", "writes")
+
+	// Edit history of post or comment and moderator rollback to one of revisions
+	endpoint("/api/posts/", revisions, "check JWT")
+	endpoint("/api/comments/", revisions, "check JWT")
+	endpoint("/api/rollback", rollback, "check JWT")
+
+	// Deleted posts and comments, their restore and purge
+	endpoint("/api/trash", trash, "check JWT")
+	endpoint("/api/restore", restore, "check JWT")
+	endpoint("/api/purge", purge, "check JWT")
+
+	// Posts and comments held by content filter and their review
+	endpoint("/api/held", held, "check JWT")
+	endpoint("/api/reviewheld", reviewheld, "check JWT")
+
+	// Bookmarks of current user
+	endpoint("/api/bookmark", bookmark, "check JWT", "personal")
+	endpoint("/api/bookmarks", bookmarks, "check JWT")
 
 	// Like-Dislike on post or comment
-	endpoint("/api/reaction", reaction, "check JWT")
+	endpoint("/api/reaction", reaction, "check JWT", "writes")
 
-	endpoint("/api/claim", claim, "check JWT")
+	endpoint("/api/claim", claim, "check JWT", "writes")
 	endpoint("/api/viewclaims", viewclaims, "check JWT")
 	endpoint("/api/doneclaim", doneclaim, "check JWT")
 
-	endpoint("/api/uploadava", uploadava, "check JWT")
-	endpoint("/api/uploadimg", uploadimg, "check JWT")
+	// Moderation queue: reports grouped into cases, assignment, notes and resolution
+	endpoint("/api/claimcases", claimcases, "check JWT")
+	endpoint("/api/claimcase", claimcase, "check JWT")
+	endpoint("/api/assignclaim", assignclaim, "check JWT")
+	endpoint("/api/claimnote", claimnote, "check JWT")
+	endpoint("/api/resolveclaim", resolveclaim, "check JWT")
+
+	// Stylesheet for highlighted code blocks in rendered posts and comments
+	endpoint("/api/highlight.css", highlightcss)
+
+	endpoint("/api/uploadava", uploadava, "check JWT", "writes")
+	endpoint("/api/uploadimg", uploadimg, "check JWT", "writes")
 
 	// ADMIN FEATURES
 	endpoint("/api/categories", categories)
 	endpoint("/api/updcategory", updcategory, "check JWT")
 	endpoint("/api/deletecategory", deletecategory, "check JWT")
 	endpoint("/api/users", users, "check JWT")
+	endpoint("/api/users/suggest", suggestusers, "check JWT")
 	endpoint("/api/changerole", changerole, "check JWT")
+	endpoint("/api/trustlevel", trustlevel, "check JWT")
+
+	// Roles with their permissions and moderators of categories
+	endpoint("/api/roles", manageroles, "check JWT")
+	endpoint("/api/deleterole", deleterole, "check JWT")
+	endpoint("/api/categorymods", categorymods, "check JWT")
+
+	// Blocklist of content filter
+	endpoint("/api/blocklist", blocklist, "check JWT")
+	endpoint("/api/unblock", unblock, "check JWT")
+
+	// Log of privileged actions and its export to CSV or JSON
+	endpoint("/api/audit", auditlog, "check JWT")
+	endpoint("/api/audit/export", auditexport, "check JWT")
+	endpoint("/api/suspend", suspend, "check JWT")
+	endpoint("/api/unsuspend", unsuspend, "check JWT")
 
 	// Listen server
 	log.Println("Running http://localhost:" + port)
@@ -80,7 +195,7 @@ func endpoint(path string, page func(w http.ResponseWriter, r *http.Request), se
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5000")
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8081")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
 
 		var isValid bool
@@ -94,8 +209,46 @@ func endpoint(path string, page func(w http.ResponseWriter, r *http.Request), se
 				http.Error(w, http.StatusText(403), 403)
 				return
 			}
+		} else if _, cookieError := r.Cookie("jwt"); cookieError == nil {
+
+			// Public endpoints still know logged in user (guest if JWT is invalid)
+			_, id, role = validateJWT(w, r)
+		}
+
+		// Banned user is a guest on public endpoints. Read-only one can't use
+		// endpoints which write content (marked with "writes") and can only
+		// read others, except those changing just their own data (marked with
+		// "personal"). Handlers read JSON body whatever the method is, so body
+		// of their reads is dropped
+		if id > 0 {
+			s := suspension(id)
+			if s.Mode == suspendReadOnly && len(secure) > 0 {
+				tag := ""
+				if len(secure) > 1 {
+					tag, _ = secure[1].(string)
+				}
+				if tag == "writes" || (tag != "personal" && r.Method != http.MethodGet) {
+					w.WriteHeader(403)
+					returnJSON(s, w)
+					return
+				}
+				if tag != "personal" {
+					r.Body = http.NoBody
+				}
+			}
+			if s.Mode == suspendBanned {
+				if len(secure) > 0 {
+					w.WriteHeader(403)
+					returnJSON(s, w)
+					return
+				}
+				id, role = 0, ""
+			}
 		}
 
+		// Any authenticated request keeps user online
+		touch(id)
+
 		// Save userID and User Role to context
 		var data ctxData
 		data.ID = id
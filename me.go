@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	// Timezones are checked without relying on zoneinfo of the server
+	_ "time/tzdata"
+)
+
+// Settings of current user: GET returns them, PATCH changes given fields
+// New email is saved only after user opens link sent to it
+func me(w http.ResponseWriter, r *http.Request) {
+	uid := ctx("user", r).(ctxData).ID
+
+	if r.Method == http.MethodPatch {
+		var upd struct {
+			Fullname      *string         `json:"fullname"`
+			Email         *string         `json:"email"`
+			Language      *string         `json:"language"`
+			Timezone      *string         `json:"timezone"`
+			Digest        *string         `json:"digest"`
+			Notifications map[string]bool `json:"notifications"`
+			Emails        map[string]bool `json:"emails"`
+			Privacy       map[string]bool `json:"privacy"`
+		}
+		readBody(r, &upd)
+
+		// Same checks as on registration
+		type report struct {
+			FullnameFormat bool
+			EmailFormat    bool
+			EmailExist     bool
+			LanguageFormat bool
+			TimezoneFormat bool
+			DigestFormat   bool
+		}
+		var valid report
+		if upd.Fullname != nil {
+			valid.FullnameFormat = regcheck(*upd.Fullname, fullnameFormat)
+		}
+		if upd.Email != nil {
+			valid.EmailFormat = regcheck(*upd.Email, emailFormat)
+			valid.EmailExist = isInDB("SELECT userId FROM users WHERE email = ?", *upd.Email)
+		}
+		if upd.Language != nil {
+			valid.LanguageFormat = true
+			for _, lang := range languages {
+				if *upd.Language == lang {
+					valid.LanguageFormat = false
+				}
+			}
+		}
+		if upd.Timezone != nil {
+			_, tzError := time.LoadLocation(*upd.Timezone)
+			valid.TimezoneFormat = tzError != nil || *upd.Timezone == "" || strings.EqualFold(*upd.Timezone, "local")
+		}
+		if upd.Digest != nil {
+			valid.DigestFormat = !validDigest(*upd.Digest)
+		}
+		if (report{}) != valid {
+			w.WriteHeader(400)
+			returnJSON(valid, w)
+			return
+		}
+
+		if upd.Fullname != nil {
+			err(insert(`UPDATE users SET fullname = $1 WHERE userId = $2`, false, *upd.Fullname, uid))
+		}
+		if upd.Language != nil {
+			err(insert(`UPDATE users SET language = $1 WHERE userId = $2`, false, *upd.Language, uid))
+		}
+		if upd.Timezone != nil {
+			err(insert(`UPDATE users SET timezone = $1 WHERE userId = $2`, false, *upd.Timezone, uid))
+		}
+		if upd.Email != nil {
+			setSetting(uid, "pendingEmail", *upd.Email)
+			mailVerification(uid, *upd.Email)
+		}
+		if upd.Digest != nil {
+			setDigest(uid, *upd.Digest)
+		}
+		setFlags(uid, "notify.", notificationTypes, upd.Notifications)
+		setFlags(uid, "email.", notificationTypes, upd.Emails)
+		setFlags(uid, "", privacyFlags, upd.Privacy)
+	}
+
+	var users []struct {
+		UserID     int64
+		Username   string
+		Fullname   string
+		Email      string
+		Role       string
+		Registered int64
+		Language   string
+		Timezone   string
+	}
+	query := `
+	SELECT
+		userId,
+		username,
+		fullname,
+		email,
+		role,
+		CAST(strftime('%s', registered) AS INT),
+		language,
+		timezone
+	FROM users WHERE userId = $1`
+	sliceFromDB(&users, query, nil, uid)
+	if len(users) == 0 {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	u := users[0]
+
+	var res struct {
+		UserID        int64           `json:"userID"`
+		Username      string          `json:"username"`
+		Fullname      string          `json:"fullname"`
+		Email         string          `json:"email"`
+		PendingEmail  string          `json:"pendingEmail"`
+		Role          string          `json:"role"`
+		Registered    int64           `json:"registered"`
+		Language      string          `json:"language"`
+		Timezone      string          `json:"timezone"`
+		Digest        string          `json:"digest"`
+		Notifications map[string]bool `json:"notifications"`
+		Emails        map[string]bool `json:"emails"`
+		Privacy       map[string]bool `json:"privacy"`
+		DeleteAt      int64           `json:"deleteAt"`
+		Suspension    suspensionInfo  `json:"suspension"`
+	}
+	res.UserID, res.Username, res.Fullname, res.Email = u.UserID, u.Username, u.Fullname, u.Email
+	res.Role, res.Registered, res.Language, res.Timezone = u.Role, u.Registered, u.Language, u.Timezone
+	res.PendingEmail = setting(uid, "pendingEmail", "")
+	res.Digest = setting(uid, "digest", "off")
+	res.Notifications = getFlags(uid, "notify.", notificationTypes, true)
+	res.Emails = getFlags(uid, "email.", notificationTypes, false)
+	res.Privacy = getFlags(uid, "", privacyFlags, false)
+	res.DeleteAt, _ = strconv.ParseInt(setting(uid, "deleteAt", "0"), 10, 64)
+	res.Suspension = suspension(uid)
+	returnJSON(res, w)
+}
+
+// Send link confirming new email address to that address
+func mailVerification(userID int64, email string) {
+	var user []struct {
+		Username string
+	}
+	sliceFromDB(&user, `SELECT username FROM users WHERE userId = $1`, nil, userID)
+	if len(user) == 0 {
+		return
+	}
+	expire := strconv.FormatInt(time.Now().Add(emailVerifyLife).Unix(), 10)
+	token := sign(strconv.FormatInt(userID, 10) + ":" + expire + ":" + email)
+
+	data := mailData{
+		Username: user[0].Username,
+		Message:  "Please confirm this is your new email address for the forum.",
+		Title:    "Confirm email",
+		Link:     siteURL() + "/api/verifyemail?token=" + token,
+	}
+	m := mail{To: email, Subject: "Confirm your email address"}
+	m.Text, m.HTML = renderMail("verify", data)
+	queueMail(m)
+}
+
+// Link from verification email, changes email of user to the confirmed one
+// Only the latest requested address can be confirmed
+func verifyemail(w http.ResponseWriter, r *http.Request) {
+	data, ok := unsign(r.FormValue("token"))
+	parts := strings.SplitN(data, ":", 3)
+	if !ok || len(parts) != 3 {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	uid, _ := strconv.ParseInt(parts[0], 10, 64)
+	expire, _ := strconv.ParseInt(parts[1], 10, 64)
+	email := parts[2]
+	if time.Now().Unix() > expire || setting(uid, "pendingEmail", "") != email {
+		http.Error(w, "Link is expired or already used", http.StatusGone)
+		return
+	}
+
+	if insert(`UPDATE users SET email = $1 WHERE userId = $2`, false, email, uid) != nil {
+		http.Error(w, "Email is already used", http.StatusConflict)
+		return
+	}
+	setSetting(uid, "pendingEmail", "")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, writeError := w.Write([]byte("Your email is confirmed."))
+	err(writeError)
+}
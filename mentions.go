@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Markdown extension turning @username of existing user into link to their profile
+type mentionExtension struct{}
+
+type mentionNode struct {
+	ast.BaseInline
+	UserID   int64
+	Username string
+}
+
+var kindMention = ast.NewNodeKind("Mention")
+
+func (n *mentionNode) Kind() ast.NodeKind {
+	return kindMention
+}
+
+func (n *mentionNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Username": n.Username}, nil)
+}
+
+func (mentionExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(util.Prioritized(mentionExtension{}, 500)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(mentionExtension{}, 500)))
+}
+
+func (mentionExtension) Trigger() []byte {
+	return []byte{'@'}
+}
+
+// Mention starts after space or punctuation (so emails are not mentions)
+// and is a whole username, unknown names stay plain text
+func (mentionExtension) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	before := block.PrecendingCharacter()
+	if before == '_' || unicode.IsLetter(before) || unicode.IsDigit(before) {
+		return nil
+	}
+	line, _ := block.PeekLine()
+	name := line[1:]
+	for i, c := range name {
+		if !isUsernameChar(c) {
+			name = name[:i]
+			break
+		}
+	}
+	if regcheck(string(name), usernameFormat) {
+		return nil
+	}
+	var user []struct {
+		ID int64
+	}
+	sliceFromDB(&user, `SELECT userId FROM users WHERE username = $1`, nil, string(name))
+	if len(user) == 0 {
+		return nil
+	}
+	block.Advance(len(name) + 1)
+	return &mentionNode{UserID: user[0].ID, Username: string(name)}
+}
+
+func (mentionExtension) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindMention, renderMention)
+}
+
+// Random attribute marking rendered mentions, renderMarkdown replaces it
+// with mention class after sanitizing, so users can not write it themselves
+var mentionMark = func() string {
+	raw := make([]byte, 16)
+	_, randError := io.ReadFull(rand.Reader, raw)
+	err(randError)
+	return `title="` + hex.EncodeToString(raw) + `"`
+}()
+
+func renderMention(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		name := node.(*mentionNode).Username
+		w.WriteString(`<a href="#/profile?username=` + name + `" ` + mentionMark + `>@` + name + `</a>`)
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func isUsernameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// IDs of users mentioned in markdown source, mentions in code are ignored
+func mentioned(source string) []int64 {
+	doc := markdown.Parser().Parse(text.NewReader([]byte(source)))
+	var ids []int64
+	seen := make(map[int64]bool)
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if m, ok := n.(*mentionNode); ok && entering && !seen[m.UserID] {
+			seen[m.UserID] = true
+			ids = append(ids, m.UserID)
+		}
+		return ast.WalkContinue, nil
+	})
+	return ids
+}
+
+// Store mentions of post (commentID is 0) or comment and notify users
+// mentioned for the first time, so editing text does not notify them again
+func saveMentions(postID, commentID, actorID int64, source string) {
+	var post []struct {
+		PostID int64
+		Title  string
+	}
+	query := `SELECT postId, title FROM posts WHERE postId = COALESCE((SELECT postId FROM comments WHERE commentId = $1), $2)`
+	sliceFromDB(&post, query, nil, commentID, postID)
+	if len(post) == 0 {
+		return
+	}
+	postID = post[0].PostID
+
+	var old []struct {
+		UserID int64
+	}
+	sliceFromDB(&old, `SELECT userId FROM mentions WHERE postId = $1 AND commentId = $2`, nil, postID, commentID)
+	known := make(map[int64]bool)
+	for _, m := range old {
+		known[m.UserID] = true
+	}
+
+	// Users who blocked author aren't mentioned
+	var ids []int64
+	for _, id := range mentioned(source) {
+		if relation(id, actorID) != relationBlock {
+			ids = append(ids, id)
+		}
+	}
+	err(execTx(func(tx *sql.Tx) error {
+		_, execError := tx.Exec(`DELETE FROM mentions WHERE postId = $1 AND commentId = $2`, postID, commentID)
+		if execError != nil {
+			return execError
+		}
+		for _, id := range ids {
+			_, execError = tx.Exec(`INSERT INTO mentions(postId, commentId, userId) VALUES ($1, $2, $3)`, postID, commentID, id)
+			if execError != nil {
+				return execError
+			}
+		}
+		return nil
+	}))
+
+	for _, id := range ids {
+		if !known[id] {
+			notify(id, notifyMention, actorID, postID, commentID, post[0].Title)
+		}
+	}
+}
+
+// Usernames starting with ?q= for mention autocomplete
+func suggestusers(w http.ResponseWriter, r *http.Request) {
+	var users []struct {
+		UserID   int64  `json:"uid"`
+		Username string `json:"username"`
+		Fullname string `json:"fullname,omitempty"`
+	}
+	q := strings.TrimPrefix(strings.TrimSpace(r.FormValue("q")), "@")
+	if !regcheck(q, `^[a-zA-Z0-9_]{1,10}$`) {
+		query := `
+		SELECT userId, username, fullname FROM users
+		WHERE username LIKE $1 ESCAPE '\'
+		ORDER BY length(username), username LIMIT 10`
+		sliceFromDB(&users, query, nil, strings.ReplaceAll(q, "_", `\_`)+"%")
+	}
+
+	// Hidden full names are shown only as in profile
+	viewer := ctx("user", r).(ctxData)
+	for i, u := range users {
+		if viewer.ID != u.UserID && !can(viewer, permUserPrivate) && setting(u.UserID, "hideFullname", "0") == "1" {
+			users[i].Fullname = ""
+		}
+	}
+	returnJSON(users, w)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type message struct {
+	MessageID      int64  `json:"id"`
+	ConversationID int64  `json:"conversationID"`
+	Sent           int64  `json:"sent"`
+	AuthorID       int64  `json:"uid"`
+	Username       string `json:"username"`
+	Text           string `json:"text"`
+	HTML           string `json:"html"`
+	Attachment     string `json:"attachment"`
+}
+
+// Columns of message, m is messages
+const messageColumns = `
+	m.messageId,
+	m.conversationId,
+	CAST(strftime('%s', m.sent) AS INT),
+	m.userId,
+	COALESCE((SELECT username FROM users u WHERE u.userId = m.userId), ''),
+	m.text,
+	m.html,
+	m.attachment`
+
+// Member of conversation, messages up to LastRead are read by them
+type conversationMember struct {
+	UserID   int64  `json:"userID"`
+	Username string `json:"username"`
+	LastRead int64  `json:"lastRead"`
+}
+
+func conversationMembers(conversationID int64) []conversationMember {
+	var members []conversationMember
+	query := `
+	SELECT cm.userId, COALESCE((SELECT username FROM users u WHERE u.userId = cm.userId), ''), cm.lastRead
+	FROM conversationMembers cm WHERE cm.conversationId = $1 ORDER BY cm.userId`
+	sliceFromDB(&members, query, nil, conversationID)
+	return members
+}
+
+func isMember(conversationID, userID int64) bool {
+	for _, m := range conversationMembers(conversationID) {
+		if m.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes error if any of users has blocked sender
+func blockedSender(w http.ResponseWriter, senderID int64, userIDs ...int64) bool {
+	for _, id := range userIDs {
+		if relation(id, senderID) == relationBlock {
+			http.Error(w, "You are blocked by one of recipients", 403)
+			return true
+		}
+	}
+	return false
+}
+
+// Message has text or image uploaded with uploadimg, or both
+func validMessage(text, attachment string) bool {
+	if attachment == "" {
+		return strings.TrimSpace(text) != ""
+	}
+	if regcheck(attachment, `^/images/[0-9]+\.(jpg|gif|png)$`) {
+		return false
+	}
+	_, statError := os.Stat("./front" + attachment)
+	return statError == nil
+}
+
+func insertMessage(tx *sql.Tx, conversationID, userID int64, text, attachment string) (int64, error) {
+	ins := `INSERT INTO messages(conversationId, userId, text, html, attachment) VALUES ($1, $2, $3, $4, $5)`
+	res, insError := tx.Exec(ins, conversationID, userID, text, renderMarkdown(text), attachment)
+	if insError != nil {
+		return 0, insError
+	}
+	id, insError := res.LastInsertId()
+	if insError != nil {
+		return 0, insError
+	}
+
+	// Sender has read their own message
+	upd := `UPDATE conversationMembers SET lastRead = $1 WHERE conversationId = $2 AND userId = $3`
+	_, updError := tx.Exec(upd, id, conversationID, userID)
+	return id, updError
+}
+
+// Push new message to members who haven't muted its author
+func deliverMessage(messageID int64) {
+	var msg []message
+	sliceFromDB(&msg, `SELECT `+messageColumns+` FROM messages m WHERE m.messageId = $1`, nil, messageID)
+	if len(msg) == 0 {
+		return
+	}
+	var topics []string
+	for _, m := range conversationMembers(msg[0].ConversationID) {
+		if relation(m.UserID, msg[0].AuthorID) == "" {
+			topics = append(topics, "user:"+strconv.FormatInt(m.UserID, 10))
+		}
+	}
+	publish("message.new", msg[0], topics...)
+}
+
+// GET lists conversations of current user, recently active first, with
+// unread messages count. POST {"userIDs", "title", "text", "attachment"}
+// starts conversation with given users by first message
+func conversations(w http.ResponseWriter, r *http.Request) {
+	uid := ctx("user", r).(ctxData).ID
+	if r.Method == http.MethodPost {
+		var req struct {
+			UserIDs    []int64 `json:"userIDs"`
+			Title      string  `json:"title"`
+			Text       string  `json:"text"`
+			Attachment string  `json:"attachment"`
+		}
+		readBody(r, &req)
+		members := []int64{uid}
+		seen := map[int64]bool{uid: true}
+		for _, id := range req.UserIDs {
+			if !seen[id] {
+				seen[id] = true
+				members = append(members, id)
+			}
+		}
+		if len(members) < 2 || len(members) > conversationSize || !validMessage(req.Text, req.Attachment) {
+			http.Error(w, http.StatusText(400), 400)
+			return
+		}
+		for _, id := range members {
+			if !isInDB(`SELECT userId FROM users WHERE userId = ?`, id) {
+				http.Error(w, http.StatusText(404), 404)
+				return
+			}
+		}
+		if blockedSender(w, uid, members...) {
+			return
+		}
+
+		var id, messageID int64
+		err(execTx(func(tx *sql.Tx) error {
+			res, execError := tx.Exec(`INSERT INTO conversations(creatorId, title) VALUES ($1, $2)`, uid, strings.TrimSpace(req.Title))
+			if execError != nil {
+				return execError
+			}
+			if id, execError = res.LastInsertId(); execError != nil {
+				return execError
+			}
+			for _, member := range members {
+				_, execError = tx.Exec(`INSERT INTO conversationMembers(conversationId, userId) VALUES ($1, $2)`, id, member)
+				if execError != nil {
+					return execError
+				}
+			}
+			messageID, execError = insertMessage(tx, id, uid, req.Text, req.Attachment)
+			return execError
+		}))
+		deliverMessage(messageID)
+
+		var created struct {
+			ConversationID int64 `json:"conversationID"`
+		}
+		created.ConversationID = id
+		returnJSON(created, w)
+		return
+	}
+
+	pageSize := 50
+	page, atoiError := strconv.Atoi(r.FormValue("page"))
+	if atoiError != nil || page <= 0 {
+		page = 1
+	}
+	list := []struct {
+		ConversationID int64         `json:"id"`
+		Title          string        `json:"title"`
+		Created        int64         `json:"created"`
+		Updated        int64         `json:"updated"`
+		Unread         int64         `json:"unread"`
+		Members        []interface{} `json:"members"`
+	}{}
+	query := `
+	SELECT
+		c.conversationId,
+		c.title,
+		CAST(strftime('%s', c.created) AS INT),
+		COALESCE((SELECT CAST(strftime('%s', MAX(m.sent)) AS INT) FROM messages m WHERE m.conversationId = c.conversationId), 0) AS updated,
+		(SELECT COUNT(*) FROM messages m WHERE m.conversationId = c.conversationId AND m.messageId > cm.lastRead AND ` + notMutedBy("m.userId") + `),
+		(SELECT GROUP_CONCAT(username) FROM users u JOIN conversationMembers o ON o.userId = u.userId WHERE o.conversationId = c.conversationId)
+	FROM conversations c JOIN conversationMembers cm ON cm.conversationId = c.conversationId AND cm.userId = $1
+	ORDER BY updated DESC LIMIT $2 OFFSET $3`
+	sliceFromDB(&list, query, splitUsernames, uid, pageSize, page*pageSize-pageSize)
+	returnJSON(list, w)
+}
+
+func splitUsernames(s string) []interface{} {
+	res := []interface{}{}
+	for _, name := range strings.Split(s, ",") {
+		res = append(res, name)
+	}
+	return res
+}
+
+// Messages of conversation by ?conversationID=, newest first, with members
+// and their last read messages. Messages of muted users are hidden
+func messages(w http.ResponseWriter, r *http.Request) {
+	uid := ctx("user", r).(ctxData).ID
+	conversationID, _ := strconv.ParseInt(r.FormValue("conversationID"), 10, 64)
+	var res struct {
+		Members  []conversationMember `json:"members"`
+		Messages []message            `json:"messages"`
+	}
+	if !isMember(conversationID, uid) {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	res.Members = conversationMembers(conversationID)
+
+	pageSize := 50
+	page, atoiError := strconv.Atoi(r.FormValue("page"))
+	if atoiError != nil || page <= 0 {
+		page = 1
+	}
+	res.Messages = []message{}
+	query := `SELECT ` + messageColumns + ` FROM messages m
+	WHERE ` + notMutedBy("m.userId") + ` AND m.conversationId = $2
+	ORDER BY m.messageId DESC LIMIT $3 OFFSET $4`
+	sliceFromDB(&res.Messages, query, nil, uid, conversationID, pageSize, page*pageSize-pageSize)
+	returnJSON(res, w)
+}
+
+// Send message {"conversationID", "text", "attachment"}
+func sendmessage(w http.ResponseWriter, r *http.Request) {
+	uid := ctx("user", r).(ctxData).ID
+	var req struct {
+		ConversationID int64  `json:"conversationID"`
+		Text           string `json:"text"`
+		Attachment     string `json:"attachment"`
+	}
+	readBody(r, &req)
+	if !isMember(req.ConversationID, uid) {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	if !validMessage(req.Text, req.Attachment) {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	var members []int64
+	for _, m := range conversationMembers(req.ConversationID) {
+		members = append(members, m.UserID)
+	}
+	if blockedSender(w, uid, members...) {
+		return
+	}
+
+	var id int64
+	err(execTx(func(tx *sql.Tx) error {
+		var insError error
+		id, insError = insertMessage(tx, req.ConversationID, uid, req.Text, req.Attachment)
+		return insError
+	}))
+	deliverMessage(id)
+
+	var sent struct {
+		MessageID int64 `json:"id"`
+	}
+	sent.MessageID = id
+	returnJSON(sent, w)
+}
+
+// Mark all messages of conversation {"conversationID"} as read, other
+// members get read receipt
+func readmessages(w http.ResponseWriter, r *http.Request) {
+	uid := ctx("user", r).(ctxData).ID
+	var req struct {
+		ConversationID int64 `json:"conversationID"`
+	}
+	readBody(r, &req)
+	if !isMember(req.ConversationID, uid) {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	query := `UPDATE conversationMembers
+		SET lastRead = COALESCE((SELECT MAX(messageId) FROM messages WHERE conversationId = $1), 0)
+		WHERE conversationId = $1 AND userId = $2`
+	err(insert(query, false, req.ConversationID, uid))
+
+	var receipt struct {
+		ConversationID int64 `json:"conversationID"`
+		UserID         int64 `json:"userID"`
+		LastRead       int64 `json:"lastRead"`
+	}
+	var topics []string
+	for _, m := range conversationMembers(req.ConversationID) {
+		topics = append(topics, "user:"+strconv.FormatInt(m.UserID, 10))
+		if m.UserID == uid {
+			receipt.ConversationID, receipt.UserID, receipt.LastRead = req.ConversationID, uid, m.LastRead
+		}
+	}
+	publish("message.read", receipt, topics...)
+}
+
+// Number of unread messages in all conversations of current user
+func unreadmessages(w http.ResponseWriter, r *http.Request) {
+	var unread []struct {
+		Count int64 `json:"count"`
+	}
+	query := `
+	SELECT COUNT(*) FROM messages m JOIN conversationMembers cm ON cm.conversationId = m.conversationId
+	WHERE cm.userId = $1 AND m.messageId > cm.lastRead AND ` + notMutedBy("m.userId")
+	sliceFromDB(&unread, query, nil, ctx("user", r).(ctxData).ID)
+	returnJSON(unread[0], w)
+}
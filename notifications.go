@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Notification types, each of them can be turned off in user preferences
+const (
+	notifyPostReply    = "post_reply"
+	notifyCommentReply = "comment_reply"
+	notifyMention      = "mention"
+	notifyMilestone    = "reaction_milestone"
+	notifyClaim        = "claim_resolved"
+	notifyRole         = "role_changed"
+	notifyFollowed     = "followed_post" // new comment in post user follows
+)
+
+var notificationTypes = []string{notifyPostReply, notifyCommentReply, notifyMention, notifyMilestone, notifyClaim, notifyRole, notifyFollowed}
+
+// Suspension notice and moderator warning can't be turned off
+const (
+	notifySuspension = "suspension"
+	notifyWarning    = "warning"
+)
+
+// Notifications n of user $1 except ones from muted users, suspension notice
+// and warning are shown anyway
+var notMutedNotification = "(" + notMutedBy("n.actorId") + " OR n.type IN ('" + notifySuspension + "', '" + notifyWarning + "'))"
+
+// Notify user unless it is their own action, they turned this type off or
+// muted the actor. Notification is also pushed to users live connections and
+// emailed if user wants
+func notify(userID int64, typ string, actorID, postID, commentID int64, text string) {
+	if userID == 0 || userID == actorID || setting(userID, "notify."+typ, "1") == "0" {
+		return
+	}
+	if relation(userID, actorID) != "" && typ != notifySuspension && typ != notifyWarning {
+		return
+	}
+	query := `INSERT INTO notifications(userId, type, actorId, postId, commentId, text) VALUES ($1, $2, $3, $4, $5, $6)`
+	err(insert(query, false, userID, typ, actorID, postID, commentID, text))
+
+	var n struct {
+		Type      string `json:"type"`
+		ActorID   int64  `json:"actorID"`
+		PostID    int64  `json:"postID"`
+		CommentID int64  `json:"commentID"`
+		Text      string `json:"text"`
+	}
+	n.Type, n.ActorID, n.PostID, n.CommentID, n.Text = typ, actorID, postID, commentID, text
+	publish("notification", n, "user:"+strconv.FormatInt(userID, 10))
+	mailNotification(userID, typ, actorID, postID, commentID, text)
+}
+
+// Notify authors of post and of replied comment about new comment
+func notifyReply(commentID int64) {
+	var c []struct {
+		PostID       int64
+		AuthorID     int64
+		Title        string
+		PostAuthor   int64
+		ParentAuthor int64
+	}
+	query := `
+	SELECT
+		c.postId,
+		c.userId,
+		p.title,
+		p.userId,
+		COALESCE((SELECT userId FROM comments pc WHERE pc.commentId = c.parentId), 0)
+	FROM comments c JOIN posts p ON p.postId = c.postId WHERE c.commentId = $1`
+	sliceFromDB(&c, query, nil, commentID)
+	if len(c) == 0 {
+		return
+	}
+	notify(c[0].ParentAuthor, notifyCommentReply, c[0].AuthorID, c[0].PostID, commentID, c[0].Title)
+	if c[0].PostAuthor != c[0].ParentAuthor {
+		notify(c[0].PostAuthor, notifyPostReply, c[0].AuthorID, c[0].PostID, commentID, c[0].Title)
+	}
+	notifyFollowers(commentID)
+}
+
+// Notify author of post or comment when its likes reach one of milestones
+func notifyMilestones(postID, commentID, actorID int64) {
+	var target []struct {
+		PostID   int64
+		AuthorID int64
+		Likes    int64
+	}
+	if commentID > 0 {
+		query := `
+		SELECT c.postId, c.userId,
+			(SELECT COUNT(*) FROM commentReactions r WHERE r.commentId = c.commentId AND reaction = 'like')
+		FROM comments c WHERE c.commentId = $1`
+		sliceFromDB(&target, query, nil, commentID)
+	} else {
+		query := `
+		SELECT p.postId, p.userId,
+			(SELECT COUNT(*) FROM postReactions r WHERE r.postId = p.postId AND reaction = 'like')
+		FROM posts p WHERE p.postId = $1`
+		sliceFromDB(&target, query, nil, postID)
+	}
+	if len(target) == 0 {
+		return
+	}
+
+	for _, m := range reactionMilestones {
+		if target[0].Likes != m {
+			continue
+		}
+
+		// Like taken back and given again does not repeat milestone
+		text := strconv.FormatInt(m, 10) + " likes"
+		var sent []struct {
+			ID int64
+		}
+		query := `SELECT notificationId FROM notifications WHERE type = $1 AND postId = $2 AND commentId = $3 AND text = $4`
+		sliceFromDB(&sent, query, nil, notifyMilestone, target[0].PostID, commentID, text)
+		if len(sent) == 0 {
+			notify(target[0].AuthorID, notifyMilestone, actorID, target[0].PostID, commentID, text)
+		}
+	}
+}
+
+// List notifications of current user, newest first (only unread with ?unread=1)
+func notifications(w http.ResponseWriter, r *http.Request) {
+	read := "%"
+	if r.FormValue("unread") == "1" {
+		read = "0"
+	}
+
+	// Pagination params
+	pageSize := 50
+	page, atoiError := strconv.Atoi(r.FormValue("page"))
+	if atoiError != nil || page <= 0 {
+		page = 1
+	}
+	offset := page*pageSize - pageSize
+
+	var list []struct {
+		NotificationID int64  `json:"id"`
+		Created        int64  `json:"created"`
+		Type           string `json:"type"`
+		ActorID        int64  `json:"actorID"`
+		Actor          string `json:"actor"`
+		PostID         int64  `json:"postID"`
+		CommentID      int64  `json:"commentID"`
+		Text           string `json:"text"`
+		Read           int64  `json:"read"`
+	}
+	query := `
+	SELECT
+		n.notificationId,
+		CAST(strftime('%s', n.created) AS INT),
+		n.type,
+		n.actorId,
+		COALESCE((SELECT username FROM users u WHERE u.userId = n.actorId), ''),
+		n.postId,
+		n.commentId,
+		n.text,
+		n.read
+	FROM notifications n
+	WHERE n.userId = $1 AND n.read LIKE $2 AND ` + notMutedNotification + `
+	ORDER BY n.notificationId DESC LIMIT $3 OFFSET $4`
+	sliceFromDB(&list, query, nil, ctx("user", r).(ctxData).ID, read, pageSize, offset)
+	returnJSON(list, w)
+}
+
+func unreadcount(w http.ResponseWriter, r *http.Request) {
+	var unread []struct {
+		Count int64 `json:"count"`
+	}
+	query := `SELECT COUNT(*) FROM notifications n WHERE n.userId = $1 AND n.read = 0 AND ` + notMutedNotification
+	sliceFromDB(&unread, query, nil, ctx("user", r).(ctxData).ID)
+	returnJSON(unread[0], w)
+}
+
+// Mark given notifications (or all of them) as read
+func readnotifications(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs []int64 `json:"ids"`
+		All bool    `json:"all"`
+	}
+	readBody(r, &req)
+	uid := ctx("user", r).(ctxData).ID
+	if req.All {
+		err(insert(`UPDATE notifications SET read = 1 WHERE userId = $1`, false, uid))
+		return
+	}
+	for _, id := range req.IDs {
+		err(insert(`UPDATE notifications SET read = 1 WHERE userId = $1 AND notificationId = $2`, false, uid, id))
+	}
+}
+
+// GET returns which notification types are on, POST {"mention": false, ...} changes them
+func notifyprefs(w http.ResponseWriter, r *http.Request) {
+	uid := ctx("user", r).(ctxData).ID
+	if r.Method == http.MethodPost {
+		var prefs map[string]bool
+		readBody(r, &prefs)
+		setFlags(uid, "notify.", notificationTypes, prefs)
+	}
+	returnJSON(getFlags(uid, "notify.", notificationTypes, true), w)
+}
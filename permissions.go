@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Permissions granted to roles, admin role has all of them
+const (
+	permPostEditAny    = "post.edit.any"    // edit and delete posts of others, see their history
+	permCommentEditAny = "comment.edit.any" // same for comments
+	permPostModerate   = "post.moderate"    // pin, lock, announce, comment locked posts
+	permRollback       = "revision.rollback"
+	permClaimView      = "claim.view"
+	permClaimResolve   = "claim.resolve"
+	permUserList       = "user.list"
+	permUserSuspend    = "user.suspend"
+	permUserPrivate    = "user.private" // see profile parts hidden by privacy flags
+	permCategoryManage = "category.manage"
+	permRoleManage     = "role.manage"
+	permAuditView      = "audit.view"
+	permFilterManage   = "filter.manage" // blocklist of content filter
+	permUserTrust      = "user.trust"    // set trust level of user
+)
+
+// Built-in roles, new users get the default one
+const (
+	adminRole   = "admin"
+	defaultRole = "user"
+)
+
+var permissionNames = []string{
+	permPostEditAny, permCommentEditAny, permPostModerate, permRollback, permClaimView, permClaimResolve,
+	permUserList, permUserSuspend, permUserPrivate, permCategoryManage, permRoleManage, permAuditView,
+	permFilterManage, permUserTrust,
+}
+
+// Category moderators have these permissions for posts (and their comments
+// and reports) in categories they moderate
+var categoryPermissions = []string{
+	permPostEditAny, permCommentEditAny, permPostModerate, permRollback, permClaimView, permClaimResolve,
+}
+
+// Permissions of roles, loaded from DB on start and after each change
+var roles = struct {
+	sync.RWMutex
+	perms map[string]map[string]bool
+}{}
+
+func loadRoles() {
+	var rows []struct {
+		Role        string
+		Permissions string
+	}
+	sliceFromDB(&rows, `SELECT role, permissions FROM roles`, nil)
+
+	perms := make(map[string]map[string]bool)
+	for _, row := range rows {
+		perms[row.Role] = make(map[string]bool)
+		for _, p := range strings.Fields(row.Permissions) {
+			perms[row.Role][p] = true
+		}
+	}
+	perms[adminRole] = make(map[string]bool)
+	for _, p := range permissionNames {
+		perms[adminRole][p] = true
+	}
+
+	roles.Lock()
+	roles.perms = perms
+	roles.Unlock()
+}
+
+func roleExists(role string) bool {
+	roles.RLock()
+	defer roles.RUnlock()
+	_, ok := roles.perms[role]
+	return ok
+}
+
+func roleCan(role, perm string) bool {
+	roles.RLock()
+	defer roles.RUnlock()
+	return roles.perms[role][perm]
+}
+
+// Central authorization check: user has permission by their role or,
+// for category permissions, moderates any of given categories
+func can(user ctxData, perm string, categories ...int64) bool {
+	if user.ID == 0 {
+		return false
+	}
+	if roleCan(user.Role, perm) {
+		return true
+	}
+	if len(categories) == 0 || !isCategoryPermission(perm) {
+		return false
+	}
+	moderated := moderatedCategories(user.ID)
+	for _, c := range categories {
+		if moderated[c] {
+			return true
+		}
+	}
+	return false
+}
+
+// Permission on post or comment, checked against categories of its post
+func canText(user ctxData, perm string, postID, commentID int64) bool {
+	return can(user, perm) || can(user, perm, textCategories(postID, commentID)...)
+}
+
+// Permission on reported text, typ is "post" or "comment"
+func canClaim(user ctxData, perm, typ string, textID int64) bool {
+	if typ == "comment" {
+		return canText(user, perm, 0, textID)
+	}
+	return canText(user, perm, textID, 0)
+}
+
+// User has permission at least in some category
+func canSome(user ctxData, perm string) bool {
+	return can(user, perm) || (user.ID > 0 && isCategoryPermission(perm) && len(moderatedCategories(user.ID)) > 0)
+}
+
+// Same check for user who is not the one making request
+func userCan(userID int64, perm string, categories ...int64) bool {
+	var users []struct {
+		Role string
+	}
+	sliceFromDB(&users, `SELECT role FROM users WHERE userId = $1`, nil, userID)
+	return len(users) > 0 && can(ctxData{userID, users[0].Role}, perm, categories...)
+}
+
+func isCategoryPermission(perm string) bool {
+	for _, p := range categoryPermissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func moderatedCategories(userID int64) map[int64]bool {
+	var cats []struct {
+		ID int64
+	}
+	sliceFromDB(&cats, `SELECT categoryId FROM categoryModerators WHERE userId = $1`, nil, userID)
+	res := make(map[int64]bool)
+	for _, c := range cats {
+		res[c.ID] = true
+	}
+	return res
+}
+
+// Categories of post, or of post of comment if commentID is given
+func textCategories(postID, commentID int64) []int64 {
+	var post []struct {
+		Categories string
+	}
+	query := `SELECT categories FROM posts WHERE postId = COALESCE((SELECT postId FROM comments WHERE commentId = $1), $2)`
+	sliceFromDB(&post, query, nil, commentID, postID)
+	if len(post) == 0 {
+		return nil
+	}
+	var res []int64
+	for _, c := range strings.FieldsFunc(post[0].Categories, func(c rune) bool { return !unicode.IsNumber(c) }) {
+		id, _ := strconv.ParseInt(c, 10, 64)
+		res = append(res, id)
+	}
+	return res
+}
+
+// Author of post, or of comment if commentID is given
+func textAuthor(postID, commentID int64) int64 {
+	var text []struct {
+		UserID int64
+	}
+	query := `SELECT userId FROM posts WHERE postId = $1 UNION ALL SELECT userId FROM comments WHERE commentId = $2`
+	sliceFromDB(&text, query, nil, postID, commentID)
+	if len(text) == 0 {
+		return 0
+	}
+	return text[0].UserID
+}
+
+type roleInfo struct {
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+	Users       int64    `json:"users"`
+}
+
+// GET lists roles and all known permissions, POST {"role", "permissions"}
+// creates role or replaces its permissions. Admin role can't be changed
+func manageroles(w http.ResponseWriter, r *http.Request) {
+	if !can(ctx("user", r).(ctxData), permRoleManage) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	if r.Method == http.MethodPost {
+		var req struct {
+			Role        string   `json:"role"`
+			Permissions []string `json:"permissions"`
+		}
+		readBody(r, &req)
+		if regcheck(req.Role, roleFormat) || req.Role == adminRole {
+			http.Error(w, "Wrong role name", 400)
+			return
+		}
+		for _, p := range req.Permissions {
+			if !validPermission(p) {
+				http.Error(w, "No such permission: "+p, 400)
+				return
+			}
+		}
+		before := roleSnapshot(req.Role)
+		query := `INSERT INTO roles(role, permissions) VALUES ($1, $2) ON CONFLICT(role) DO UPDATE SET permissions = $2`
+		err(insert(query, false, req.Role, strings.Join(req.Permissions, " ")))
+		loadRoles()
+		audit(r, "role.update", "role", 0, before, roleSnapshot(req.Role))
+	}
+
+	var res struct {
+		Roles       []roleInfo `json:"roles"`
+		Permissions []string   `json:"permissions"`
+	}
+	var counts []struct {
+		Role  string
+		Users int64
+	}
+	sliceFromDB(&counts, `SELECT role, COUNT(*) FROM users GROUP BY role`, nil)
+	users := make(map[string]int64)
+	for _, c := range counts {
+		users[c.Role] = c.Users
+	}
+
+	roles.RLock()
+	for role, perms := range roles.perms {
+		info := roleInfo{Role: role, Permissions: []string{}, Users: users[role]}
+		for _, p := range permissionNames {
+			if perms[p] {
+				info.Permissions = append(info.Permissions, p)
+			}
+		}
+		res.Roles = append(res.Roles, info)
+	}
+	roles.RUnlock()
+	sort.Slice(res.Roles, func(i, j int) bool { return res.Roles[i].Role < res.Roles[j].Role })
+	res.Permissions = permissionNames
+	returnJSON(res, w)
+}
+
+func validPermission(perm string) bool {
+	for _, p := range permissionNames {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete role nobody has, built-in roles stay
+func deleterole(w http.ResponseWriter, r *http.Request) {
+	if !can(ctx("user", r).(ctxData), permRoleManage) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	var req struct {
+		Role string `json:"role"`
+	}
+	readBody(r, &req)
+	if req.Role == adminRole || req.Role == defaultRole || !roleExists(req.Role) {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	if isInDB(`SELECT userId FROM users WHERE role = ?`, req.Role) {
+		http.Error(w, "Role is in use", http.StatusConflict)
+		return
+	}
+	before := roleSnapshot(req.Role)
+	err(insert(`DELETE FROM roles WHERE role = $1`, false, req.Role))
+	loadRoles()
+	audit(r, "role.delete", "role", 0, before, nil)
+}
+
+// GET ?userID= returns categories moderated by user, POST {"userID", "categories"} replaces them
+func categorymods(w http.ResponseWriter, r *http.Request) {
+	if !can(ctx("user", r).(ctxData), permRoleManage) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	var req struct {
+		UserID     int64   `json:"userID"`
+		Categories []int64 `json:"categories"`
+	}
+	if r.Method == http.MethodPost {
+		readBody(r, &req)
+		if !isInDB(`SELECT userId FROM users WHERE userId = ?`, req.UserID) {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+		if _, catsError := processCategories(req.Categories); catsError != nil {
+			http.Error(w, "No such category", 400)
+			return
+		}
+		before := categoryList(req.UserID)
+		err(execTx(func(tx *sql.Tx) error {
+			_, execError := tx.Exec(`DELETE FROM categoryModerators WHERE userId = $1`, req.UserID)
+			if execError != nil {
+				return execError
+			}
+			for _, cat := range req.Categories {
+				_, execError = tx.Exec(`INSERT OR IGNORE INTO categoryModerators(userId, categoryId) VALUES ($1, $2)`, req.UserID, cat)
+				if execError != nil {
+					return execError
+				}
+			}
+			return nil
+		}))
+		audit(r, "user.categories", "user", req.UserID, before, categoryList(req.UserID))
+	} else {
+		req.UserID, _ = strconv.ParseInt(r.FormValue("userID"), 10, 64)
+	}
+	req.Categories = categoryList(req.UserID)
+	returnJSON(req, w)
+}
+
+// Sorted IDs of categories moderated by user
+func categoryList(userID int64) []int64 {
+	res := []int64{}
+	for c := range moderatedCategories(userID) {
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Moderator action on post: pin (globally or in category, optionally until
+// given time), unpin, lock, unlock, announce, unannounce
+func moderatepost(w http.ResponseWriter, r *http.Request) {
+	var action struct {
+		PostID     int64  `json:"postID"`
+		Action     string `json:"action"`
+		CategoryID int64  `json:"categoryID"`
+		Until      int64  `json:"until"`
+	}
+	readBody(r, &action)
+	if !canText(ctx("user", r).(ctxData), permPostModerate, action.PostID, 0) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	if !isInDB("SELECT postId FROM posts WHERE status IN (1, 2) AND postId = ?", action.PostID) {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	// Post ID is always the last query argument
+	var query string
+	var args []interface{}
+	switch action.Action {
+	case "pin":
+		if action.CategoryID != 0 && !isInDB("SELECT categoryId FROM categories WHERE categoryId = ?", action.CategoryID) {
+			http.Error(w, "No such category", 400)
+			return
+		}
+		query = `UPDATE posts SET
+			pinned = 1,
+			pinCategory = $1,
+			pinUntil = CASE WHEN $2 > 0 THEN datetime($2, 'unixepoch') END
+			WHERE postId = $3`
+		args = append(args, action.CategoryID, action.Until)
+	case "unpin":
+		query = `UPDATE posts SET pinned = 0, pinCategory = 0, pinUntil = NULL WHERE postId = $1`
+	case "lock":
+		query = `UPDATE posts SET locked = 1 WHERE postId = $1`
+	case "unlock":
+		query = `UPDATE posts SET locked = 0 WHERE postId = $1`
+	case "announce":
+		query = `UPDATE posts SET announcement = 1 WHERE postId = $1`
+	case "unannounce":
+		query = `UPDATE posts SET announcement = 0 WHERE postId = $1`
+	default:
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	args = append(args, action.PostID)
+	before := postSnapshot(action.PostID)
+	err(insert(query, false, args...))
+	audit(r, "post."+action.Action, "post", action.PostID, before, postSnapshot(action.PostID))
+}
+
+// Locked post accepts no new comments and reactions (on itself and its comments)
+func isLocked(postID, commentID int64) bool {
+	var post []struct {
+		Locked int64
+	}
+	query := `SELECT locked FROM posts WHERE postId = COALESCE((SELECT postId FROM comments WHERE commentId = $1), $2)`
+	sliceFromDB(&post, query, nil, commentID, postID)
+	return len(post) > 0 && post[0].Locked == 1
+}
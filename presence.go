@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Last activity of users and viewers of posts (logged in user or guest IP)
+var presence = struct {
+	sync.Mutex
+	users   map[int64]time.Time
+	viewers map[int64]map[string]time.Time
+}{
+	users:   make(map[int64]time.Time),
+	viewers: make(map[int64]map[string]time.Time),
+}
+
+// Mark user as active now
+func touch(userID int64) {
+	if userID == 0 {
+		return
+	}
+	presence.Lock()
+	presence.users[userID] = time.Now()
+	presence.Unlock()
+}
+
+// Mark viewer as looking at post now
+func viewPost(postID int64, viewer string) {
+	presence.Lock()
+	if presence.viewers[postID] == nil {
+		presence.viewers[postID] = make(map[string]time.Time)
+	}
+	presence.viewers[postID][viewer] = time.Now()
+	presence.Unlock()
+}
+
+// Viewer of post is logged in user or guest by IP address
+func viewerKey(r *http.Request) string {
+	if uid := ctx("user", r).(ctxData).ID; uid > 0 {
+		return "user:" + strconv.FormatInt(uid, 10)
+	}
+	return "ip:" + clientIP(r)
+}
+
+// Live connection keeps its user online and viewing posts it is subscribed to
+func (c *liveClient) present() {
+	var posts []int64
+	hub.Lock()
+	for t := range c.topics {
+		if strings.HasPrefix(t, "post:") {
+			id, _ := strconv.ParseInt(strings.TrimPrefix(t, "post:"), 10, 64)
+			posts = append(posts, id)
+		}
+	}
+	hub.Unlock()
+
+	touch(c.userID)
+	for _, id := range posts {
+		viewPost(id, "user:"+strconv.FormatInt(c.userID, 10))
+	}
+}
+
+// Forget users and viewers inactive longer than presenceTimeout
+func prunePresence() {
+	expired := time.Now().Add(-presenceTimeout)
+	presence.Lock()
+	defer presence.Unlock()
+	for id, seen := range presence.users {
+		if seen.Before(expired) {
+			delete(presence.users, id)
+		}
+	}
+	for postID, viewers := range presence.viewers {
+		for key, seen := range viewers {
+			if seen.Before(expired) {
+				delete(viewers, key)
+			}
+		}
+		if len(viewers) == 0 {
+			delete(presence.viewers, postID)
+		}
+	}
+}
+
+// Who's online: count of all active users and names of those not hiding presence
+func online(w http.ResponseWriter, r *http.Request) {
+	prunePresence()
+
+	var ids []interface{}
+	presence.Lock()
+	for id := range presence.users {
+		ids = append(ids, id)
+	}
+	presence.Unlock()
+
+	var res struct {
+		Count int      `json:"count"`
+		Users []string `json:"users"`
+	}
+	res.Count = len(ids)
+	res.Users = []string{}
+
+	if len(ids) > 0 {
+		var users []struct {
+			Username string
+		}
+		query := `
+		SELECT username FROM users u
+		WHERE userId IN (?` + strings.Repeat(", ?", len(ids)-1) + `)
+		AND NOT EXISTS (SELECT 1 FROM settings s WHERE s.userId = u.userId AND s.name = 'hidePresence' AND s.value = '1')
+		ORDER BY username`
+		sliceFromDB(&users, query, nil, ids...)
+		for _, u := range users {
+			res.Users = append(res.Users, u.Username)
+		}
+	}
+	returnJSON(res, w)
+}
+
+// Number of users and guests currently viewing post
+func viewers(w http.ResponseWriter, r *http.Request) {
+	postID, parseError := strconv.ParseInt(r.FormValue("postID"), 10, 64)
+	if parseError != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	prunePresence()
+
+	var res struct {
+		PostID  int64 `json:"postID"`
+		Viewers int   `json:"viewers"`
+	}
+	res.PostID = postID
+	presence.Lock()
+	res.Viewers = len(presence.viewers[postID])
+	presence.Unlock()
+	returnJSON(res, w)
+}
+
+// User hides or shows own name in who's online list
+func hidepresence(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Hidden bool `json:"hidden"`
+	}
+	readBody(r, &req)
+	value := "0"
+	if req.Hidden {
+		value = "1"
+	}
+	setSetting(ctx("user", r).(ctxData).ID, "hidePresence", value)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Privacy flags of user, each hides part of profile (or name in who's online)
+// from everyone except the user and moderators
+var privacyFlags = []string{"hideFullname", "hideStats", "hideActivity", "hidePresence"}
+
+type profileStats struct {
+	Posts            int64 `json:"posts"`
+	Comments         int64 `json:"comments"`
+	LikesGiven       int64 `json:"likesGiven"`
+	DislikesGiven    int64 `json:"dislikesGiven"`
+	LikesReceived    int64 `json:"likesReceived"`
+	DislikesReceived int64 `json:"dislikesReceived"`
+}
+
+type profileActivity struct {
+	Type      string `json:"type"`
+	PostID    int64  `json:"postID"`
+	CommentID int64  `json:"commentID"`
+	Title     string `json:"title"`
+	Created   int64  `json:"created"`
+}
+
+// Public profile of user by ?username= with statistics and recent posts and comments
+func profile(w http.ResponseWriter, r *http.Request) {
+	var users []struct {
+		UserID           int64
+		Username         string
+		Fullname         string
+		Role             string
+		Registered       int64
+		Posts            int64
+		Comments         int64
+		LikesGiven       int64
+		DislikesGiven    int64
+		LikesReceived    int64
+		DislikesReceived int64
+	}
+	query := `
+	SELECT
+		u.userId,
+		u.username,
+		u.fullname,
+		u.role,
+		CAST(strftime('%s', u.registered) AS INT),
+		(SELECT COUNT(*) FROM posts p WHERE p.userId = u.userId AND p.status IN (1, 2)),
+		(SELECT COUNT(*) FROM comments c WHERE c.userId = u.userId AND c.status IN (1, 2)),
+		(SELECT COUNT(*) FROM postReactions r WHERE r.userId = u.userId AND reaction = 'like')
+			+ (SELECT COUNT(*) FROM commentReactions r WHERE r.userId = u.userId AND reaction = 'like'),
+		(SELECT COUNT(*) FROM postReactions r WHERE r.userId = u.userId AND reaction = 'dislike')
+			+ (SELECT COUNT(*) FROM commentReactions r WHERE r.userId = u.userId AND reaction = 'dislike'),
+		(SELECT COUNT(*) FROM postReactions r JOIN posts p ON p.postId = r.postId WHERE p.userId = u.userId AND reaction = 'like')
+			+ (SELECT COUNT(*) FROM commentReactions r JOIN comments c ON c.commentId = r.commentId WHERE c.userId = u.userId AND reaction = 'like'),
+		(SELECT COUNT(*) FROM postReactions r JOIN posts p ON p.postId = r.postId WHERE p.userId = u.userId AND reaction = 'dislike')
+			+ (SELECT COUNT(*) FROM commentReactions r JOIN comments c ON c.commentId = r.commentId WHERE c.userId = u.userId AND reaction = 'dislike')
+	FROM users u WHERE u.username = $1`
+	sliceFromDB(&users, query, nil, r.FormValue("username"))
+	if len(users) == 0 {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	user := users[0]
+
+	var res struct {
+		UserID     int64             `json:"uid"`
+		Username   string            `json:"username"`
+		Fullname   string            `json:"fullname,omitempty"`
+		Avatar     string            `json:"avatar"`
+		Role       string            `json:"role"`
+		Registered int64             `json:"registered"`
+		TrustLevel int64             `json:"trustLevel"`
+		Stats      *profileStats     `json:"stats,omitempty"`
+		Activity   []profileActivity `json:"activity,omitempty"`
+	}
+	res.UserID = user.UserID
+	res.Username = user.Username
+	res.Role = user.Role
+	res.Registered = user.Registered
+	res.TrustLevel = trustLevel(user.UserID)
+
+	// Avatar uploaded with uploadava, front shows placeholder if empty
+	avatar := "/avatars/" + strconv.FormatInt(user.UserID, 10) + ".jpg"
+	if _, statError := os.Stat("./front" + avatar); statError == nil {
+		res.Avatar = avatar
+	}
+
+	viewer := ctx("user", r).(ctxData)
+	shown := func(flag string) bool {
+		return viewer.ID == user.UserID || can(viewer, permUserPrivate) || setting(user.UserID, flag, "0") != "1"
+	}
+	if shown("hideFullname") {
+		res.Fullname = user.Fullname
+	}
+	if shown("hideStats") {
+		res.Stats = &profileStats{user.Posts, user.Comments, user.LikesGiven, user.DislikesGiven, user.LikesReceived, user.DislikesReceived}
+	}
+	if shown("hideActivity") {
+		query := `
+		SELECT * FROM (
+			SELECT 'post', p.postId, 0, p.title, CAST(strftime('%s', p.posted) AS INT) AS created
+			FROM posts p WHERE p.userId = $1 AND p.status IN (1, 2)
+			UNION ALL
+			SELECT 'comment', c.postId, c.commentId, p.title, CAST(strftime('%s', c.commented) AS INT)
+			FROM comments c JOIN posts p ON p.postId = c.postId
+			WHERE c.userId = $1 AND c.status IN (1, 2) AND p.status IN (1, 2)
+		) ORDER BY created DESC LIMIT $2`
+		sliceFromDB(&res.Activity, query, nil, user.UserID, profileActivitySize)
+	}
+	returnJSON(res, w)
+}
+
+// GET returns privacy flags of current user, POST {"hideStats": true, ...} changes them
+func privacy(w http.ResponseWriter, r *http.Request) {
+	uid := ctx("user", r).(ctxData).ID
+	if r.Method == http.MethodPost {
+		var flags map[string]bool
+		readBody(r, &flags)
+		setFlags(uid, "", privacyFlags, flags)
+	}
+	returnJSON(getFlags(uid, "", privacyFlags, false), w)
+}
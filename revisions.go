@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Save current state of post as new revision if it differs from the last one
+func postRevision(tx *sql.Tx, postID, editorID int64, reason string) error {
+	query := `
+	INSERT INTO postRevisions(postId, editorId, reason, title, text, categories)
+	SELECT p.postId, $1, $2, p.title, p.text, p.categories FROM posts p
+	WHERE p.postId = $3 AND NOT EXISTS (
+		SELECT 1 FROM postRevisions v
+		WHERE v.revisionId = (SELECT MAX(revisionId) FROM postRevisions WHERE postId = $3)
+		AND v.title = p.title AND v.text = p.text AND v.categories = p.categories)`
+	_, execError := tx.Exec(query, editorID, reason, postID)
+	return execError
+}
+
+// Save current state of comment as new revision if it differs from the last one
+func commentRevision(tx *sql.Tx, commentID, editorID int64, reason string) error {
+	query := `
+	INSERT INTO commentRevisions(commentId, editorId, reason, comment)
+	SELECT c.commentId, $1, $2, c.comment FROM comments c
+	WHERE c.commentId = $3 AND NOT EXISTS (
+		SELECT 1 FROM commentRevisions v
+		WHERE v.revisionId = (SELECT MAX(revisionId) FROM commentRevisions WHERE commentId = $3)
+		AND v.comment = c.comment)`
+	_, execError := tx.Exec(query, editorID, reason, commentID)
+	return execError
+}
+
+// Get edit history of post or comment with diffs between versions
+// Path: /api/posts/{id}/revisions or /api/comments/{id}/revisions
+func revisions(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) != 4 || path[3] != "revisions" {
+		http.NotFound(w, r)
+		return
+	}
+	id, parseError := strconv.ParseInt(path[2], 10, 64)
+	if parseError != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	user := ctx("user", r).(ctxData)
+
+	var revs []struct {
+		RevisionID int64         `json:"revisionID"`
+		Edited     int64         `json:"edited"`
+		EditorID   int64         `json:"editorID"`
+		Editor     string        `json:"editor"`
+		Reason     string        `json:"reason"`
+		Title      string        `json:"title"`
+		Text       string        `json:"text"`
+		Categories []interface{} `json:"categories"`
+		Diff       string        `json:"diff"`
+	}
+
+	// History is visible to author of text and those who can edit it
+	var query string
+	var editAny bool
+	switch path[1] {
+	case "posts":
+		editAny = canText(user, permPostEditAny, id, 0)
+		query = `
+		SELECT
+			v.revisionId,
+			CAST(strftime('%s', v.edited) AS INT),
+			v.editorId,
+			COALESCE((SELECT username FROM users u WHERE u.userId = v.editorId), ''),
+			v.reason,
+			v.title,
+			v.text,
+			v.categories,
+			''
+		FROM postRevisions v WHERE v.postId = $1
+		AND ($2 OR (SELECT userId FROM posts WHERE postId = $1) = $3)
+		ORDER BY v.revisionId`
+	case "comments":
+		editAny = canText(user, permCommentEditAny, 0, id)
+		query = `
+		SELECT
+			v.revisionId,
+			CAST(strftime('%s', v.edited) AS INT),
+			v.editorId,
+			COALESCE((SELECT username FROM users u WHERE u.userId = v.editorId), ''),
+			v.reason,
+			'',
+			v.comment,
+			'',
+			''
+		FROM commentRevisions v WHERE v.commentId = $1
+		AND ($2 OR (SELECT userId FROM comments WHERE commentId = $1) = $3)
+		ORDER BY v.revisionId`
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	sliceFromDB(&revs, query, getCats, id, editAny, user.ID)
+	if len(revs) == 0 {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+
+	// Title goes on top of text, so its change is visible in diff too
+	doc := func(title, text string) string {
+		if title == "" {
+			return text
+		}
+		return title + "\n\n" + text
+	}
+
+	for i := 1; i < len(revs); i++ {
+		prev, cur := revs[i-1], revs[i]
+		revs[i].Diff = unifiedDiff(
+			"revision "+strconv.FormatInt(prev.RevisionID, 10),
+			"revision "+strconv.FormatInt(cur.RevisionID, 10),
+			doc(prev.Title, prev.Text),
+			doc(cur.Title, cur.Text))
+	}
+	returnJSON(revs, w)
+}
+
+// Moderator restores post or comment to one of its previous revisions
+func rollback(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PostID     int64  `json:"postID"`
+		CommentID  int64  `json:"commentID"`
+		RevisionID int64  `json:"revisionID"`
+		Reason     string `json:"reason"`
+	}
+	readBody(r, &req)
+	if !canText(ctx("user", r).(ctxData), permRollback, req.PostID, req.CommentID) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+
+	uid := ctx("user", r).(ctxData).ID
+	reason := "rollback to revision " + strconv.FormatInt(req.RevisionID, 10)
+	if strings.TrimSpace(req.Reason) != "" {
+		reason += ": " + strings.TrimSpace(req.Reason)
+	}
+
+	// Source of revision to restore, it must belong to given post or comment
+	var rev []struct {
+		Title      string
+		Text       string
+		Categories string
+	}
+	if req.PostID > 0 && req.CommentID == 0 {
+		query := `SELECT title, text, categories FROM postRevisions WHERE revisionId = $1 AND postId = $2`
+		sliceFromDB(&rev, query, nil, req.RevisionID, req.PostID)
+	} else if req.PostID == 0 && req.CommentID > 0 {
+		query := `SELECT '', comment, '' FROM commentRevisions WHERE revisionId = $1 AND commentId = $2`
+		sliceFromDB(&rev, query, nil, req.RevisionID, req.CommentID)
+	} else {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+	if len(rev) == 0 {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+
+	var before interface{}
+	if req.CommentID > 0 {
+		before = commentSnapshot(req.CommentID)
+	} else {
+		before = postSnapshot(req.PostID)
+	}
+
+	// Only published texts are rolled back, not ones in trash, drafts or held
+	html := renderMarkdown(rev[0].Text)
+	e := execTx(func(tx *sql.Tx) error {
+		if req.CommentID > 0 {
+			upd := `UPDATE comments SET comment = $1, html = $2 WHERE commentId = $3 AND status IN (1, 2)`
+			res, updError := tx.Exec(upd, rev[0].Text, html, req.CommentID)
+			if updError != nil {
+				return updError
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return sql.ErrNoRows
+			}
+			return commentRevision(tx, req.CommentID, uid, reason)
+		}
+		upd := `UPDATE posts SET title = $1, text = $2, html = $3, categories = $4 WHERE postId = $5 AND status IN (1, 2)`
+		res, updError := tx.Exec(upd, rev[0].Title, rev[0].Text, html, rev[0].Categories, req.PostID)
+		if updError != nil {
+			return updError
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+		return postRevision(tx, req.PostID, uid, reason)
+	})
+	if e == sql.ErrNoRows {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	err(e)
+	if req.CommentID > 0 {
+		audit(r, "comment.rollback", "comment", req.CommentID, before, commentSnapshot(req.CommentID))
+	} else {
+		audit(r, "post.rollback", "post", req.PostID, before, postSnapshot(req.PostID))
+	}
+	saveMentions(req.PostID, req.CommentID, uid, rev[0].Text)
+}
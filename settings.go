@@ -0,0 +1,44 @@
+package main
+
+// Per user setting, def is returned if user has not changed it
+func setting(userID int64, name, def string) string {
+	var value []struct {
+		Value string
+	}
+	sliceFromDB(&value, `SELECT value FROM settings WHERE userId = $1 AND name = $2`, nil, userID, name)
+	if len(value) == 0 {
+		return def
+	}
+	return value[0].Value
+}
+
+func setSetting(userID int64, name, value string) {
+	query := `INSERT OR REPLACE INTO settings(userId, name, value) VALUES ($1, $2, $3)`
+	err(insert(query, false, userID, name, value))
+}
+
+// Boolean settings stored as "1" and "0" under prefix+name, keyed by name
+func getFlags(userID int64, prefix string, names []string, def bool) map[string]bool {
+	value := "0"
+	if def {
+		value = "1"
+	}
+	flags := make(map[string]bool)
+	for _, name := range names {
+		flags[name] = setting(userID, prefix+name, value) == "1"
+	}
+	return flags
+}
+
+// Change only given flags which are known
+func setFlags(userID int64, prefix string, names []string, flags map[string]bool) {
+	for _, name := range names {
+		if on, ok := flags[name]; ok {
+			value := "0"
+			if on {
+				value = "1"
+			}
+			setSetting(userID, prefix+name, value)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Suspension modes, read-only user can't write anything, banned one can't log in
+const (
+	suspendReadOnly = "readonly"
+	suspendBanned   = "banned"
+)
+
+// Current restriction is also kept in users.status
+const (
+	userActive   = 123 // default of users.status
+	userReadOnly = 1
+	userBanned   = 0
+)
+
+type suspensionInfo struct {
+	Mode   string `json:"mode"`
+	Until  int64  `json:"until"` // 0 is permanent
+	Reason string `json:"reason"`
+}
+
+// Active suspension of user, Mode is empty if there is none
+func suspension(userID int64) suspensionInfo {
+	var active []suspensionInfo
+	query := `
+	SELECT mode, COALESCE(CAST(strftime('%s', until) AS INT), 0), reason FROM suspensions
+	WHERE userId = $1 AND lifted IS NULL AND (until IS NULL OR until > CURRENT_TIMESTAMP)
+	ORDER BY suspensionId DESC LIMIT 1`
+	sliceFromDB(&active, query, nil, userID)
+	if len(active) == 0 {
+		return suspensionInfo{}
+	}
+	return active[0]
+}
+
+func validSuspension(mode string, until int64) bool {
+	return (mode == suspendReadOnly || mode == suspendBanned) && (until == 0 || until > time.Now().Unix())
+}
+
+// Suspend user until given time (0 is permanently), new suspension replaces
+// the active one. Only role managers can suspend those who can suspend others
+func suspend(w http.ResponseWriter, r *http.Request) {
+	moderator := ctx("user", r).(ctxData)
+	if !can(moderator, permUserSuspend) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	var req struct {
+		UserID int64  `json:"userID"`
+		Mode   string `json:"mode"`
+		Until  int64  `json:"until"`
+		Reason string `json:"reason"`
+	}
+	readBody(r, &req)
+	if !validSuspension(req.Mode, req.Until) {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	if code := suspendable(moderator, req.UserID); code != 0 {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	before := suspension(req.UserID)
+	suspendUser(req.UserID, moderator.ID, req.Mode, req.Until, req.Reason)
+	audit(r, "user.suspend", "user", req.UserID, before, suspension(req.UserID))
+}
+
+// HTTP error code if moderator can't suspend user, 0 if allowed
+// Role managers (admins) are never suspended
+func suspendable(moderator ctxData, userID int64) int {
+	if !can(moderator, permUserSuspend) {
+		return 403
+	}
+	var target []struct {
+		Role string
+	}
+	sliceFromDB(&target, `SELECT role FROM users WHERE userId = $1`, nil, userID)
+	if len(target) == 0 {
+		return 404
+	}
+	if userID == moderator.ID || roleCan(target[0].Role, permRoleManage) ||
+		(!can(moderator, permRoleManage) && roleCan(target[0].Role, permUserSuspend)) {
+		return 403
+	}
+	return 0
+}
+
+func suspendUser(userID, moderatorID int64, mode string, until int64, reason string) {
+	status := userReadOnly
+	if mode == suspendBanned {
+		status = userBanned
+	}
+	liftSuspension(userID, moderatorID)
+	query := `INSERT INTO suspensions(userId, moderatorId, mode, until, reason) VALUES ($1, $2, $3, CASE WHEN $4 > 0 THEN datetime($4, 'unixepoch') END, $5)`
+	err(insert(query, false, userID, moderatorID, mode, until, reason))
+	err(insert(`UPDATE users SET status = $1 WHERE userId = $2`, false, status, userID))
+
+	// Banned user is logged out at once
+	if mode == suspendBanned {
+		endSession(userID)
+	}
+	text := mode
+	if until > 0 {
+		text += " until " + time.Unix(until, 0).UTC().Format("2006-01-02 15:04 UTC")
+	}
+	if reason != "" {
+		text += ": " + reason
+	}
+	notify(userID, notifySuspension, moderatorID, 0, 0, text)
+}
+
+// Lift active suspension of user before its time
+func unsuspend(w http.ResponseWriter, r *http.Request) {
+	moderator := ctx("user", r).(ctxData)
+	if !can(moderator, permUserSuspend) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	var req struct {
+		UserID int64 `json:"userID"`
+	}
+	readBody(r, &req)
+	if suspension(req.UserID).Mode == "" {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	before := suspension(req.UserID)
+	liftSuspension(req.UserID, moderator.ID)
+	audit(r, "user.unsuspend", "user", req.UserID, before, suspension(req.UserID))
+	notify(req.UserID, notifySuspension, moderator.ID, 0, 0, "lifted")
+}
+
+func liftSuspension(userID, moderatorID int64) {
+	query := `UPDATE suspensions SET lifted = CURRENT_TIMESTAMP, liftedBy = $1 WHERE userId = $2 AND lifted IS NULL`
+	err(insert(query, false, moderatorID, userID))
+	err(insert(`UPDATE users SET status = $1 WHERE userId = $2`, false, userActive, userID))
+}
+
+// Lift suspensions which time is over
+func liftExpired() {
+	var expired []struct {
+		UserID int64
+	}
+	query := `SELECT DISTINCT userId FROM suspensions WHERE lifted IS NULL AND until IS NOT NULL AND until <= CURRENT_TIMESTAMP`
+	sliceFromDB(&expired, query, nil)
+	for _, s := range expired {
+		if suspension(s.UserID).Mode == "" {
+			liftSuspension(s.UserID, 0)
+			notify(s.UserID, notifySuspension, 0, 0, 0, "lifted")
+		}
+	}
+}
+
+// Suspensions of user, newest first (for admin users list)
+func suspensionHistory(userID string) []interface{} {
+	var history []struct {
+		ID        int64  `json:"id"`
+		Created   int64  `json:"created"`
+		Moderator string `json:"moderator"`
+		Mode      string `json:"mode"`
+		Until     int64  `json:"until"`
+		Reason    string `json:"reason"`
+		Lifted    int64  `json:"lifted"`
+	}
+	query := `
+	SELECT
+		s.suspensionId,
+		CAST(strftime('%s', s.created) AS INT),
+		COALESCE((SELECT username FROM users u WHERE u.userId = s.moderatorId), ''),
+		s.mode,
+		COALESCE(CAST(strftime('%s', s.until) AS INT), 0),
+		s.reason,
+		COALESCE(CAST(strftime('%s', s.lifted) AS INT), 0)
+	FROM suspensions s WHERE s.userId = $1 ORDER BY s.suspensionId DESC`
+	id, _ := strconv.ParseInt(userID, 10, 64)
+	sliceFromDB(&history, query, nil, id)
+
+	var res []interface{}
+	for _, h := range history {
+		res = append(res, h)
+	}
+	return res
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Deleted post or comment keeps its status before deletion, so it can be
+// restored, and who deleted it. It is purged after trashRetention
+func trashPost(postID, userID int64) {
+	query := `UPDATE posts SET prevStatus = status, status = 0, deletedBy = $1, deleted = CURRENT_TIMESTAMP WHERE postId = $2 AND status != 0`
+	err(insert(query, false, userID, postID))
+}
+
+func trashComment(commentID, userID int64) {
+	query := `UPDATE comments SET prevStatus = status, status = 0, deletedBy = $1, deleted = CURRENT_TIMESTAMP WHERE commentId = $2 AND status != 0`
+	err(insert(query, false, userID, commentID))
+}
+
+type trashItem struct {
+	Type      string `json:"type"`
+	PostID    int64  `json:"postID"`
+	CommentID int64  `json:"commentID"`
+	Title     string `json:"title"`
+	Text      string `json:"text"`
+	AuthorID  int64  `json:"authorID"`
+	Author    string `json:"author"`
+	DeletedBy string `json:"deletedBy"`
+	Deleted   int64  `json:"deleted"`
+	Removal   string `json:"removal"` // "author", "moderator" or "unknown" for old deletions
+	PurgeAt   int64  `json:"purgeAt"`
+}
+
+// Deleted posts and comments, newest first, ?type= is "post" or "comment"
+// Category moderators see only texts of their categories
+func trash(w http.ResponseWriter, r *http.Request) {
+	user := ctx("user", r).(ctxData)
+	if !canSome(user, permPostEditAny) && !canSome(user, permCommentEditAny) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	pageSize := 50
+	page, atoiError := strconv.Atoi(r.FormValue("page"))
+	if atoiError != nil || page <= 0 {
+		page = 1
+	}
+
+	var items []trashItem
+	query := `
+	SELECT * FROM (
+		SELECT
+			'post' AS type,
+			p.postId,
+			0,
+			p.title,
+			p.text,
+			p.userId,
+			COALESCE((SELECT username FROM users u WHERE u.userId = p.userId), ''),
+			COALESCE((SELECT username FROM users u WHERE u.userId = p.deletedBy), ''),
+			COALESCE(CAST(strftime('%s', p.deleted) AS INT), 0) AS deletedAt,
+			CASE WHEN p.deletedBy = 0 THEN 'unknown' WHEN p.deletedBy = p.userId THEN 'author' ELSE 'moderator' END,
+			0
+		FROM posts p WHERE p.status = 0
+		UNION ALL
+		SELECT
+			'comment',
+			c.postId,
+			c.commentId,
+			COALESCE((SELECT title FROM posts p WHERE p.postId = c.postId), ''),
+			c.comment,
+			c.userId,
+			COALESCE((SELECT username FROM users u WHERE u.userId = c.userId), ''),
+			COALESCE((SELECT username FROM users u WHERE u.userId = c.deletedBy), ''),
+			COALESCE(CAST(strftime('%s', c.deleted) AS INT), 0),
+			CASE WHEN c.deletedBy = 0 THEN 'unknown' WHEN c.deletedBy = c.userId THEN 'author' ELSE 'moderator' END,
+			0
+		FROM comments c WHERE c.status = 0
+	) WHERE type LIKE $1 ORDER BY deletedAt DESC`
+	sliceFromDB(&items, query, nil, reqQuery("type", r))
+
+	visible := []trashItem{}
+	for _, item := range items {
+		perm := permPostEditAny
+		if item.Type == "comment" {
+			perm = permCommentEditAny
+		}
+		if !canText(user, perm, item.PostID, 0) {
+			continue
+		}
+		if item.Deleted > 0 {
+			item.PurgeAt = item.Deleted + int64(trashRetention/time.Second)
+		}
+		visible = append(visible, item)
+	}
+
+	offset := page*pageSize - pageSize
+	if offset > len(visible) {
+		offset = len(visible)
+	}
+	end := offset + pageSize
+	if end > len(visible) {
+		end = len(visible)
+	}
+	returnJSON(visible[offset:end], w)
+}
+
+// Checks request {postID} or {commentID} for restore and purge, target must be in trash
+func trashTarget(w http.ResponseWriter, r *http.Request) (postID, commentID int64, ok bool) {
+	var req struct {
+		PostID    int64 `json:"postID"`
+		CommentID int64 `json:"commentID"`
+	}
+	readBody(r, &req)
+	user := ctx("user", r).(ctxData)
+
+	var query string
+	var allowed bool
+	if req.PostID > 0 && req.CommentID == 0 {
+		query = `SELECT postId FROM posts WHERE status = 0 AND postId = ?`
+		allowed = canText(user, permPostEditAny, req.PostID, 0)
+	} else if req.PostID == 0 && req.CommentID > 0 {
+		query = `SELECT commentId FROM comments WHERE status = 0 AND commentId = ?`
+		allowed = canText(user, permCommentEditAny, 0, req.CommentID)
+	} else {
+		http.Error(w, http.StatusText(400), 400)
+		return 0, 0, false
+	}
+	if !allowed {
+		http.Error(w, http.StatusText(403), 403)
+		return 0, 0, false
+	}
+	if !isInDB(query, req.PostID+req.CommentID) {
+		http.Error(w, http.StatusText(404), 404)
+		return 0, 0, false
+	}
+	return req.PostID, req.CommentID, true
+}
+
+// Put post or comment back with the status it had before deletion
+func restore(w http.ResponseWriter, r *http.Request) {
+	postID, commentID, ok := trashTarget(w, r)
+	if !ok {
+		return
+	}
+	if commentID > 0 {
+		before := commentSnapshot(commentID)
+		query := `UPDATE comments SET status = prevStatus, deletedBy = 0, deleted = NULL WHERE commentId = $1`
+		err(insert(query, false, commentID))
+		audit(r, "comment.restore", "comment", commentID, before, commentSnapshot(commentID))
+		liveComment("comment.new", commentID)
+		return
+	}
+	before := postSnapshot(postID)
+	query := `UPDATE posts SET status = prevStatus, deletedBy = 0, deleted = NULL WHERE postId = $1`
+	err(insert(query, false, postID))
+	audit(r, "post.restore", "post", postID, before, postSnapshot(postID))
+	livePost("post.new", postID)
+}
+
+// Delete post or comment from trash for good
+func purge(w http.ResponseWriter, r *http.Request) {
+	postID, commentID, ok := trashTarget(w, r)
+	if !ok {
+		return
+	}
+	if commentID > 0 {
+		before := commentSnapshot(commentID)
+		purgeComments(commentID)
+		audit(r, "comment.purge", "comment", commentID, before, nil)
+		return
+	}
+	before := postSnapshot(postID)
+	purgePost(postID)
+	audit(r, "post.purge", "post", postID, before, nil)
+}
+
+// Post is purged with all its comments, reactions, revisions, mentions and
+// reports, all at once
+func purgePost(postID int64) {
+	var comments []struct {
+		ID int64
+	}
+	sliceFromDB(&comments, `SELECT commentId FROM comments WHERE postId = $1`, nil, postID)
+	var ids []int64
+	for _, c := range comments {
+		ids = append(ids, c.ID)
+	}
+
+	queries := []string{
+		`DELETE FROM posts WHERE postId = $1`,
+		`DELETE FROM postRevisions WHERE postId = $1`,
+		`DELETE FROM postReactions WHERE postId = $1`,
+		`DELETE FROM mentions WHERE postId = $1`,
+		`DELETE FROM notifications WHERE postId = $1`,
+		`DELETE FROM bookmarks WHERE postId = $1`,
+		`DELETE FROM follows WHERE type = 'post' AND targetId = $1`,
+		`DELETE FROM postReads WHERE postId = $1`,
+		`DELETE FROM claimNotes WHERE caseId IN (SELECT caseId FROM claimCases WHERE type = 'post' AND textId = $1)`,
+		`DELETE FROM claims WHERE type = 'post' AND textId = $1`,
+		`DELETE FROM claimCases WHERE type = 'post' AND textId = $1`,
+	}
+	err(execTx(func(tx *sql.Tx) error {
+		if execError := purgeCommentsTx(tx, ids...); execError != nil {
+			return execError
+		}
+		for _, query := range queries {
+			if _, execError := tx.Exec(query, postID); execError != nil {
+				return execError
+			}
+		}
+		return nil
+	}))
+}
+
+func purgeComments(commentIDs ...int64) {
+	err(execTx(func(tx *sql.Tx) error {
+		return purgeCommentsTx(tx, commentIDs...)
+	}))
+}
+
+func purgeCommentsTx(tx *sql.Tx, commentIDs ...int64) error {
+	queries := []string{
+		`DELETE FROM comments WHERE commentId = $1`,
+		`DELETE FROM commentRevisions WHERE commentId = $1`,
+		`DELETE FROM commentReactions WHERE commentId = $1`,
+		`DELETE FROM mentions WHERE commentId = $1`,
+		`DELETE FROM notifications WHERE commentId = $1`,
+		`DELETE FROM bookmarks WHERE commentId = $1`,
+		`DELETE FROM claimNotes WHERE caseId IN (SELECT caseId FROM claimCases WHERE type = 'comment' AND textId = $1)`,
+		`DELETE FROM claims WHERE type = 'comment' AND textId = $1`,
+		`DELETE FROM claimCases WHERE type = 'comment' AND textId = $1`,
+	}
+	for _, id := range commentIDs {
+		for _, query := range queries {
+			if _, execError := tx.Exec(query, id); execError != nil {
+				return execError
+			}
+		}
+	}
+	return nil
+}
+
+// Purge posts and comments which are in trash longer than retention period
+func purgeTrash() {
+	var expired []struct {
+		Type string
+		ID   int64
+	}
+	query := `
+	SELECT 'post', postId FROM posts WHERE status = 0 AND deleted < datetime($1, 'unixepoch')
+	UNION ALL
+	SELECT 'comment', commentId FROM comments WHERE status = 0 AND deleted < datetime($1, 'unixepoch')`
+	sliceFromDB(&expired, query, nil, time.Now().Add(-trashRetention).Unix())
+	for _, e := range expired {
+		if e.Type == "post" {
+			purgePost(e.ID)
+		} else {
+			purgeComments(e.ID)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Trust levels, unlocked by activity or set by admin
+const (
+	trustNew     = 0 // only comments and reports
+	trustBasic   = 1
+	trustMember  = 2
+	trustRegular = 3
+)
+
+type trustInfo struct {
+	UserID     int64 `json:"userID"`
+	Level      int64 `json:"level"`
+	Computed   int64 `json:"computed"`
+	Overridden bool  `json:"overridden"`
+}
+
+// Trust level of user with the reason it has. Moderators are always trusted
+func userTrust(userID int64) trustInfo {
+	var users []struct {
+		Registered int64
+		Override   int64
+		Posts      int64
+		Comments   int64
+		Likes      int64
+		Actioned   int64
+		Suspended  int64
+	}
+	query := `
+	SELECT
+		CAST(strftime('%s', u.registered) AS INT),
+		COALESCE(u.trustLevel, -1),
+		(SELECT COUNT(*) FROM posts p WHERE p.userId = u.userId AND p.status IN (1, 2)),
+		(SELECT COUNT(*) FROM comments c WHERE c.userId = u.userId AND c.status IN (1, 2)),
+		(SELECT COUNT(*) FROM postReactions r JOIN posts p ON p.postId = r.postId WHERE p.userId = u.userId AND reaction = 'like')
+			+ (SELECT COUNT(*) FROM commentReactions r JOIN comments c ON c.commentId = r.commentId WHERE c.userId = u.userId AND reaction = 'like'),
+		(SELECT COUNT(*) FROM claimCases k WHERE k.state = $1 AND k.type = 'post' AND k.textId IN (SELECT postId FROM posts WHERE userId = u.userId))
+			+ (SELECT COUNT(*) FROM claimCases k WHERE k.state = $1 AND k.type = 'comment' AND k.textId IN (SELECT commentId FROM comments WHERE userId = u.userId)),
+		(SELECT COUNT(*) FROM suspensions s WHERE s.userId = u.userId)
+	FROM users u WHERE u.userId = $2`
+	sliceFromDB(&users, query, nil, caseActioned, userID)
+	res := trustInfo{UserID: userID}
+	if len(users) == 0 {
+		return res
+	}
+	user := users[0]
+
+	if userCan(userID, permPostEditAny) {
+		res.Computed = trustRegular
+	} else {
+		days := int64(time.Since(time.Unix(user.Registered, 0)) / (24 * time.Hour))
+		for _, req := range trustRequirements {
+			if days < req.Days || user.Posts+user.Comments < req.Texts || user.Posts < req.Posts || user.Comments < req.Comments || user.Likes < req.Likes {
+				break
+			}
+			res.Computed++
+		}
+		res.Computed -= user.Actioned + user.Suspended
+		if res.Computed < trustNew {
+			res.Computed = trustNew
+		}
+	}
+
+	res.Level = res.Computed
+	if user.Override >= 0 {
+		res.Level, res.Overridden = user.Override, true
+	}
+	return res
+}
+
+func trustLevel(userID int64) int64 {
+	return userTrust(userID).Level
+}
+
+// Writes error if user's trust level is below required one
+func trusted(w http.ResponseWriter, userID, level int64) bool {
+	if trustLevel(userID) < level {
+		http.Error(w, "Trust level is too low", 403)
+		return false
+	}
+	return true
+}
+
+// GET ?userID= returns trust level of user, POST {"userID", "level"} sets it
+// (-1 returns computed level back)
+func trustlevel(w http.ResponseWriter, r *http.Request) {
+	if !can(ctx("user", r).(ctxData), permUserTrust) {
+		http.Error(w, http.StatusText(403), 403)
+		return
+	}
+	var req struct {
+		UserID int64 `json:"userID"`
+		Level  int64 `json:"level"`
+	}
+	if r.Method == http.MethodPost {
+		readBody(r, &req)
+		if req.Level < -1 || req.Level > trustRegular {
+			http.Error(w, http.StatusText(400), 400)
+			return
+		}
+		if !isInDB(`SELECT userId FROM users WHERE userId = ?`, req.UserID) {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+		before := userTrust(req.UserID)
+		query := `UPDATE users SET trustLevel = CASE WHEN $1 >= 0 THEN $1 END WHERE userId = $2`
+		err(insert(query, false, req.Level, req.UserID))
+		audit(r, "user.trust", "user", req.UserID, before, userTrust(req.UserID))
+	} else {
+		req.UserID, _ = strconv.ParseInt(r.FormValue("userID"), 10, 64)
+	}
+	returnJSON(userTrust(req.UserID), w)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// User registered days ago with published posts and comments, likes are
+// given to their first post
+func trustUser(name string, days, posts, comments, likes int) int64 {
+	query := `INSERT INTO users(username, email, password, fullname, registered)
+		VALUES ($1, $2, '', '', datetime('now', $3))`
+	err(insert(query, false, name, name+"@example.com", "-"+strconv.Itoa(days)+" days"))
+	var users []struct {
+		ID int64
+	}
+	sliceFromDB(&users, `SELECT userId FROM users WHERE username = $1`, nil, name)
+	id := users[0].ID
+
+	for i := 0; i < posts; i++ {
+		err(insert(`INSERT INTO posts(userId, title, text, categories) VALUES ($1, 'title', 'text', '[]')`, false, id))
+	}
+	for i := 0; i < comments; i++ {
+		err(insert(`INSERT INTO comments(postId, userId, comment) VALUES (1, $1, 'comment')`, false, id))
+	}
+	for i := 0; i < likes; i++ {
+		query := `INSERT INTO postReactions(postId, userId, reaction)
+			VALUES ((SELECT MIN(postId) FROM posts WHERE userId = $1), $2, 'like')`
+		err(insert(query, false, id, 1000+i))
+	}
+	return id
+}
+
+func TestUserTrust(t *testing.T) {
+	legacyDB(t)
+	migrate(migrations)
+	loadRoles()
+
+	// Post of admin to comment on
+	err(insert(`INSERT INTO posts(userId, title, text, categories) VALUES (1, 'title', 'text', '[]')`, false))
+
+	tests := []struct {
+		name                         string
+		days, posts, comments, likes int
+		want                         int64
+	}{
+		{"fresh", 0, 0, 0, 0, trustNew},
+		{"first day", 0, 1, 1, 0, trustNew},
+		{"silent", 1, 0, 0, 0, trustNew},
+		{"commenter", 1, 0, 1, 0, trustBasic},
+		{"author", 1, 1, 0, 0, trustBasic},
+		{"member", 7, 3, 10, 5, trustMember},
+		{"member early", 6, 3, 10, 5, trustBasic},
+		{"member few posts", 7, 2, 10, 5, trustBasic},
+		{"member few comms", 7, 3, 9, 5, trustBasic},
+		{"member few likes", 7, 3, 10, 4, trustBasic},
+		{"regular", 30, 10, 50, 25, trustRegular},
+		{"regular early", 29, 10, 50, 25, trustMember},
+		{"regular few posts", 30, 9, 50, 25, trustMember},
+		{"regular few comms", 30, 10, 49, 25, trustMember},
+		{"regular few likes", 30, 10, 50, 24, trustMember},
+	}
+	for i, tt := range tests {
+		id := trustUser("user"+strconv.Itoa(i), tt.days, tt.posts, tt.comments, tt.likes)
+		if got := userTrust(id); got.Level != tt.want || got.Computed != tt.want || got.Overridden {
+			t.Errorf("%s: got %+v, want level %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Suspension takes one level away, but not below the lowest
+	id := trustUser("suspended", 7, 3, 10, 5)
+	err(insert(`INSERT INTO suspensions(userId, moderatorId, mode) VALUES ($1, 1, 'readonly')`, false, id))
+	if got := trustLevel(id); got != trustBasic {
+		t.Errorf("suspended member: got %d, want %d", got, trustBasic)
+	}
+	id = trustUser("suspended2", 1, 1, 0, 0)
+	err(insert(`INSERT INTO suspensions(userId, moderatorId, mode) VALUES ($1, 1, 'readonly')`, false, id))
+	if got := trustLevel(id); got != trustNew {
+		t.Errorf("suspended basic: got %d, want %d", got, trustNew)
+	}
+
+	// Level set by admin wins over computed one
+	id = trustUser("override", 0, 0, 0, 0)
+	err(insert(`UPDATE users SET trustLevel = $1 WHERE userId = $2`, false, trustRegular, id))
+	if got := userTrust(id); got.Level != trustRegular || got.Computed != trustNew || !got.Overridden {
+		t.Errorf("override: got %+v", got)
+	}
+
+	// Moderators are always trusted
+	if got := trustLevel(1); got != trustRegular {
+		t.Errorf("admin: got %d, want %d", got, trustRegular)
+	}
+}